@@ -0,0 +1,142 @@
+//go:build ratelimitbench
+// +build ratelimitbench
+
+// Benchmarks the rate limit algorithms against the per-request timestamp
+// log they replaced, with 100k distinct client IPs. Run with `make bench`.
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goproxy/ratelimit"
+)
+
+const (
+	distinctIPs = 100000
+	// requestsPerIP is how many requests each IP sends before the retained
+	// memory is measured
+	requestsPerIP = 50
+)
+
+var rate = ratelimit.PerMinute(100, 20)
+
+func main() {
+	ips := make([]string, distinctIPs)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)
+	}
+
+	limiters := []struct {
+		name string
+		new  func() ratelimit.Limiter
+	}{
+		{"sliding_log (before)", func() ratelimit.Limiter { return newSlidingLog(rate) }},
+		{ratelimit.AlgorithmTokenBucket, mustLimiter(ratelimit.AlgorithmTokenBucket)},
+		{ratelimit.AlgorithmGCRA, mustLimiter(ratelimit.AlgorithmGCRA)},
+		{ratelimit.AlgorithmSlidingWindow, mustLimiter(ratelimit.AlgorithmSlidingWindow)},
+	}
+
+	fmt.Printf("%d distinct IPs, %d requests/min, burst %d, GOMAXPROCS=%d\n\n",
+		distinctIPs, rate.Limit, rate.Burst, runtime.GOMAXPROCS(0))
+	fmt.Printf("%-22s %12s %12s %12s %14s\n", "algorithm", "ns/op", "parallel", "allocs/op", "retained MB")
+	for _, l := range limiters {
+		serial := testing.Benchmark(func(b *testing.B) {
+			limiter := l.new()
+			b.ReportAllocs()
+			now := time.Now()
+			for i := 0; i < b.N; i++ {
+				limiter.Allow(ips[i%distinctIPs], now.Add(time.Duration(i)*time.Microsecond))
+			}
+		})
+		parallel := testing.Benchmark(func(b *testing.B) {
+			limiter := l.new()
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := next.Add(1)
+					limiter.Allow(ips[i%distinctIPs], time.Now())
+				}
+			})
+		})
+		fmt.Printf("%-22s %12d %12d %12d %14.1f\n", l.name, serial.NsPerOp(), parallel.NsPerOp(),
+			serial.AllocsPerOp(), retainedMB(l.new, ips))
+	}
+}
+
+func mustLimiter(algorithm string) func() ratelimit.Limiter {
+	return func() ratelimit.Limiter {
+		limiter, err := ratelimit.NewLimiter(algorithm, rate)
+		if err != nil {
+			panic(err)
+		}
+		return limiter
+	}
+}
+
+// retainedMB measures the heap held by a limiter after every IP has sent
+// requestsPerIP requests
+func retainedMB(newLimiter func() ratelimit.Limiter, ips []string) float64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	limiter := newLimiter()
+	now := time.Now()
+	for n := 0; n < requestsPerIP; n++ {
+		for _, ip := range ips {
+			limiter.Allow(ip, now)
+		}
+		now = now.Add(100 * time.Millisecond)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(limiter)
+	return float64(after.HeapAlloc-before.HeapAlloc) / (1 << 20)
+}
+
+// slidingLog is the previous limiter: a timestamp per allowed request,
+// copied into a new slice on every call
+type slidingLog struct {
+	rate     ratelimit.Rate
+	limiters sync.Map
+}
+
+type ipLog struct {
+	mu       sync.Mutex
+	requests []time.Time
+}
+
+func newSlidingLog(rate ratelimit.Rate) *slidingLog {
+	return &slidingLog{rate: rate}
+}
+
+func (l *slidingLog) Allow(key string, now time.Time) ratelimit.Decision {
+	value, ok := l.limiters.Load(key)
+	if !ok {
+		value, _ = l.limiters.LoadOrStore(key, &ipLog{})
+	}
+	log := value.(*ipLog)
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	windowStart := now.Add(-l.rate.Window)
+	valid := make([]time.Time, 0, len(log.requests))
+	for _, t := range log.requests {
+		if t.After(windowStart) {
+			valid = append(valid, t)
+		}
+	}
+	log.requests = valid
+	if len(log.requests) < l.rate.Limit {
+		log.requests = append(log.requests, now)
+		return ratelimit.Decision{Allowed: true, Rate: l.rate, Remaining: l.rate.Limit - len(log.requests)}
+	}
+	return ratelimit.Decision{Rate: l.rate}
+}
+
+func (l *slidingLog) SetRate(rate ratelimit.Rate) { l.rate = rate }
+func (l *slidingLog) Sweep(time.Time) int         { return 0 }
+func (l *slidingLog) Len() int                    { return 0 }
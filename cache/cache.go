@@ -1,7 +1,9 @@
 package cache
 
 import (
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,19 +12,126 @@ type Response struct {
 	Headers    map[string][]string
 	Body       []byte
 	ExpiresAt  time.Time
+
+	// StoredAt and InitialAge (the age the response already had when it
+	// arrived) give the response's current age for the Age header
+	StoredAt   time.Time
+	InitialAge time.Duration
+	// Shareable marks responses that may be served to requests carrying
+	// Authorization or Cookie (the origin said public, s-maxage or
+	// must-revalidate)
+	Shareable bool
+}
+
+// Fresh reports whether the response is still within its freshness lifetime
+func (r *Response) Fresh(now time.Time) bool {
+	return now.Before(r.ExpiresAt)
+}
+
+// Validators reports whether the response carries an ETag or Last-Modified
+// it can be revalidated with
+func (r *Response) Validators() bool {
+	h := http.Header(r.Headers)
+	return h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// Staleness returns how long ago the response expired (negative while fresh)
+func (r *Response) Staleness(now time.Time) time.Duration {
+	return now.Sub(r.ExpiresAt)
+}
+
+// MustRevalidate reports whether the origin forbids serving the response
+// once it is stale without checking with it first
+func (r *Response) MustRevalidate() bool {
+	cc := ParseCacheControl(r.Headers)
+	return cc.Has("must-revalidate") || cc.Has("proxy-revalidate") || cc.Has("no-cache")
+}
+
+// ServableStale reports whether the expired response is still within the
+// window of an RFC 5861 directive (stale-while-revalidate or stale-if-error).
+// def applies when the origin didn't send the directive.
+func (r *Response) ServableStale(directive string, def time.Duration, now time.Time) bool {
+	if r.MustRevalidate() {
+		return false
+	}
+	window, ok := ParseCacheControl(r.Headers).Seconds(directive)
+	if !ok {
+		window = def
+	}
+	return window > 0 && r.Staleness(now) <= window
+}
+
+// Age returns how old the response is at now
+func (r *Response) Age(now time.Time) time.Duration {
+	return r.InitialAge + now.Sub(r.StoredAt)
+}
+
+// Satisfies reports whether the stored response may be used for a request
+// with the given Cache-Control directives (max-age, min-fresh, max-stale,
+// no-cache)
+func (r *Response) Satisfies(reqCC Directives, now time.Time) bool {
+	if reqCC.Has("no-cache") {
+		return false
+	}
+	if !r.Fresh(now) {
+		// Only a client's max-stale allows using an expired response here
+		maxStale, ok := reqCC["max-stale"]
+		if !ok || r.MustRevalidate() {
+			return false
+		}
+		if limit, ok := reqCC.Seconds("max-stale"); ok && maxStale != "" && r.Staleness(now) > limit {
+			return false
+		}
+	}
+	if maxAge, ok := reqCC.Seconds("max-age"); ok && r.Age(now) > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.Seconds("min-fresh"); ok && r.ExpiresAt.Sub(now) < minFresh {
+		return false
+	}
+	return true
 }
 
 type Manager struct {
-	cache    sync.Map
-	ttl      time.Duration
-	stopChan chan struct{}
+	store           Store
+	// varyIndex maps a primary key to the header names its responses vary on
+	varyIndex       sync.Map
+	fetches         fetches
+	ttl             atomic.Int64
+	staleRetention  atomic.Int64
+	cleanupInterval time.Duration
+	stopChan        chan struct{}
+}
+
+// Stats describes a store's contents and what it has dropped
+type Stats struct {
+	// Tier names the store: memory or disk
+	Tier    string
+	Entries int
+	Bytes   int64
+	// Evictions counts entries dropped to make room, Expired entries swept
+	// after their stale retention, Rejected responses not stored because
+	// they were too large or not admitted by the eviction policy
+	Evictions int64
+	Expired   int64
+	Rejected  int64
+	// Promotions counts disk entries copied into memory (tiered store only)
+	Promotions int64
 }
 
-func New(ttl time.Duration) *Manager {
+// New creates a cache manager on top of store. cleanupInterval controls how
+// often expired entries are swept.
+func New(ttl time.Duration, store Store, cleanupInterval time.Duration) *Manager {
+	if cleanupInterval <= 0 {
+		cleanupInterval = time.Minute
+	}
 	manager := &Manager{
-		ttl:      ttl,
-		stopChan: make(chan struct{}),
+		store:           store,
+		cleanupInterval: cleanupInterval,
+		stopChan:        make(chan struct{}),
 	}
+	manager.SetTTL(ttl)
+	manager.rebuildVaryIndex()
 	
 	// Start cleanup goroutine
 	go manager.cleanup()
@@ -31,69 +140,133 @@ func New(ttl time.Duration) *Manager {
 }
 
 func (m *Manager) Set(key string, response *Response) {
-	response.ExpiresAt = time.Now().Add(m.ttl)
-	m.cache.Store(key, response)
+	m.SetWithTTL(key, response, m.TTL())
 }
 
-func (m *Manager) Get(key string) *Response {
-	if value, ok := m.cache.Load(key); ok {
-		response := value.(*Response)
-		
-		// Check if expired
-		if time.Now().After(response.ExpiresAt) {
-			m.cache.Delete(key)
-			return nil
+// SetWithTTL stores response to expire after ttl instead of the default TTL
+func (m *Manager) SetWithTTL(key string, response *Response, ttl time.Duration) {
+	if response.StoredAt.IsZero() {
+		response.StoredAt = time.Now()
+	}
+	response.ExpiresAt = response.StoredAt.Add(ttl)
+	m.store.Set(key, response)
+}
+
+// Store saves response under the variant of key selected by the request
+// headers named in vary (the response's Vary header)
+func (m *Manager) Store(key string, vary []string, reqHeader http.Header, response *Response, ttl time.Duration) {
+	if len(vary) == 0 {
+		m.varyIndex.Delete(key)
+	} else {
+		m.varyIndex.Store(key, vary)
+	}
+	m.SetWithTTL(VariantKey(key, vary, reqHeader), response, ttl)
+}
+
+// rebuildVaryIndex restores the Vary index from variant keys already in the
+// store, e.g. entries loaded from disk
+func (m *Manager) rebuildVaryIndex() {
+	for _, variant := range m.store.Keys() {
+		if key, vary := parseVariantKey(variant); len(vary) > 0 {
+			m.varyIndex.Store(key, vary)
 		}
-		
+	}
+}
+
+// Lookup returns the response stored under key for a request with reqHeader,
+// honoring the Vary header of the stored response
+func (m *Manager) Lookup(key string, reqHeader http.Header) *Response {
+	return m.Get(m.variantKey(key, reqHeader))
+}
+
+// LookupStale is Lookup that also returns expired entries still retained
+func (m *Manager) LookupStale(key string, reqHeader http.Header) *Response {
+	return m.GetStale(m.variantKey(key, reqHeader))
+}
+
+// Peek is LookupStale without counting as a use of the entry, for background
+// work that shouldn't keep entries from being evicted. Body is nil for
+// entries only on disk.
+func (m *Manager) Peek(key string, reqHeader http.Header) *Response {
+	return m.store.Peek(m.variantKey(key, reqHeader))
+}
+
+// variantKey returns the key of the variant of key a request with reqHeader
+// selects
+func (m *Manager) variantKey(key string, reqHeader http.Header) string {
+	var vary []string
+	if v, ok := m.varyIndex.Load(key); ok {
+		vary = v.([]string)
+	}
+	return VariantKey(key, vary, reqHeader)
+}
+
+// SetTTL changes the TTL applied to entries stored from now on
+func (m *Manager) SetTTL(ttl time.Duration) {
+	m.ttl.Store(int64(ttl))
+}
+
+func (m *Manager) TTL() time.Duration {
+	return time.Duration(m.ttl.Load())
+}
+
+// SetStaleRetention sets how long entries are kept after they expire, so they
+// can still be revalidated
+func (m *Manager) SetStaleRetention(d time.Duration) {
+	m.staleRetention.Store(int64(d))
+}
+
+func (m *Manager) StaleRetention() time.Duration {
+	return time.Duration(m.staleRetention.Load())
+}
+
+// Get returns the entry for key if it is still fresh
+func (m *Manager) Get(key string) *Response {
+	if response := m.GetStale(key); response != nil && response.Fresh(time.Now()) {
 		return response
 	}
-	
 	return nil
 }
 
+// GetStale returns the entry for key even if it has expired
+func (m *Manager) GetStale(key string) *Response {
+	return m.store.Get(key)
+}
+
 func (m *Manager) Delete(key string) {
-	m.cache.Delete(key)
+	m.store.Delete(key)
 }
 
 func (m *Manager) Clear() {
-	m.cache = sync.Map{}
+	m.store.Clear()
 }
 
 func (m *Manager) Size() int {
-	count := 0
-	m.cache.Range(func(key, value interface{}) bool {
-		count++
-		return true
-	})
-	return count
+	return m.store.Len()
+}
+
+// Stats returns one entry per storage tier
+func (m *Manager) Stats() []Stats {
+	return m.store.Stats()
 }
 
 func (m *Manager) cleanup() {
-	ticker := time.NewTicker(1 * time.Minute)
+	ticker := time.NewTicker(m.cleanupInterval)
 	defer ticker.Stop()
 	
 	for {
 		select {
 		case <-ticker.C:
-			m.removeExpired()
+			m.store.RemoveExpired(time.Now().Add(-m.StaleRetention()))
 		case <-m.stopChan:
 			return
 		}
 	}
 }
 
-func (m *Manager) removeExpired() {
-	now := time.Now()
-	
-	m.cache.Range(func(key, value interface{}) bool {
-		response := value.(*Response)
-		if now.After(response.ExpiresAt) {
-			m.cache.Delete(key)
-		}
-		return true
-	})
-}
-
-func (m *Manager) Close() {
+// Close stops the cleanup loop and closes the store, which persists the
+// disk index
+func (m *Manager) Close() error {
 	close(m.stopChan)
+	return m.store.Close()
 } 
\ No newline at end of file
@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Peek doesn't count as a use, so a peeked entry is still the one evicted
+func TestPeekDoesNotPromote(t *testing.T) {
+	for _, lookup := range []string{"Peek", "LookupStale"} {
+		store, err := NewMemoryStore(Limits{MaxEntries: 2, Policy: "lru"})
+		if err != nil {
+			t.Fatalf("NewMemoryStore: %v", err)
+		}
+		m := New(time.Minute, store, 0)
+		m.Set("a", &Response{StatusCode: http.StatusOK, Body: []byte("a")})
+		m.Set("b", &Response{StatusCode: http.StatusOK, Body: []byte("b")})
+		if lookup == "Peek" {
+			m.Peek("a", nil)
+		} else {
+			m.LookupStale("a", nil)
+		}
+		m.Set("c", &Response{StatusCode: http.StatusOK, Body: []byte("c")})
+
+		evicted := "b"
+		if lookup == "Peek" {
+			evicted = "a"
+		}
+		if m.Peek(evicted, nil) != nil {
+			t.Errorf("after %s(a): %s should have been evicted", lookup, evicted)
+		}
+		m.Close()
+	}
+}
@@ -0,0 +1,38 @@
+package cache
+
+import "sync"
+
+// fetches tracks upstream fetches in progress so concurrent misses for the
+// same key can wait for one fetch instead of each going to the backend
+type fetches struct {
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+}
+
+// BeginFetch registers a fetch for key. If one is already in progress it
+// returns false and a channel that is closed when that fetch ends. Otherwise
+// it returns true and the caller must call EndFetch when done.
+func (m *Manager) BeginFetch(key string) (<-chan struct{}, bool) {
+	m.fetches.mu.Lock()
+	defer m.fetches.mu.Unlock()
+	if done, ok := m.fetches.pending[key]; ok {
+		return done, false
+	}
+	if m.fetches.pending == nil {
+		m.fetches.pending = make(map[string]chan struct{})
+	}
+	done := make(chan struct{})
+	m.fetches.pending[key] = done
+	return done, true
+}
+
+// EndFetch wakes up everyone waiting on the fetch for key
+func (m *Manager) EndFetch(key string) {
+	m.fetches.mu.Lock()
+	done := m.fetches.pending[key]
+	delete(m.fetches.pending, key)
+	m.fetches.mu.Unlock()
+	if done != nil {
+		close(done)
+	}
+}
@@ -0,0 +1,443 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// indexFlushInterval is how often a changed disk index is written out
+const indexFlushInterval = 5 * time.Second
+
+// DiskStore keeps response bodies in files under a directory, with an index
+// of keys and response metadata in index.json. The index is loaded on start,
+// so the cache survives restarts; it is flushed periodically and on Close.
+type DiskStore struct {
+	dir    string
+	limits Limits
+
+	mu      sync.Mutex
+	entries map[string]*diskEntry
+	policy  Policy
+	bytes   int64
+	dirty   bool
+
+	evictions int64
+	expired   int64
+	rejected  int64
+
+	seq  atomic.Int64
+	stop chan struct{}
+	done chan struct{}
+}
+
+// diskEntry is a response's index record; the body lives in File
+type diskEntry struct {
+	File       string              `json:"file"`
+	StatusCode int                 `json:"status"`
+	Headers    map[string][]string `json:"headers"`
+	ExpiresAt  time.Time           `json:"expires_at"`
+	StoredAt   time.Time           `json:"stored_at"`
+	InitialAge time.Duration       `json:"initial_age"`
+	Shareable  bool                `json:"shareable"`
+	Size       int64               `json:"size"`
+}
+
+// response returns the entry's metadata as a Response without its body
+func (e *diskEntry) response() *Response {
+	return &Response{
+		StatusCode: e.StatusCode,
+		Headers:    e.Headers,
+		ExpiresAt:  e.ExpiresAt,
+		StoredAt:   e.StoredAt,
+		InitialAge: e.InitialAge,
+		Shareable:  e.Shareable,
+	}
+}
+
+type diskIndex struct {
+	Version int                   `json:"version"`
+	Entries map[string]*diskEntry `json:"entries"`
+}
+
+// NewDiskStore opens (or creates) a disk store in dir, loading its index
+func NewDiskStore(dir string, limits Limits) (*DiskStore, error) {
+	policy, err := NewPolicy(limits.Policy, limits.MaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{"objects", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("creating cache directory: %w", err)
+		}
+	}
+	s := &DiskStore{
+		dir:     dir,
+		limits:  limits,
+		entries: make(map[string]*diskEntry),
+		policy:  policy,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.flushLoop()
+	return s, nil
+}
+
+func (s *DiskStore) indexPath() string {
+	return filepath.Join(s.dir, "index.json")
+}
+
+func (s *DiskStore) objectPath(file string) string {
+	return filepath.Join(s.dir, "objects", file)
+}
+
+// load reads the index, dropping entries whose files are gone and files no
+// entry refers to (e.g. written just before a crash)
+func (s *DiskStore) load() error {
+	var index diskIndex
+	data, err := os.ReadFile(s.indexPath())
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("reading cache index: %w", err)
+	default:
+		if err := json.Unmarshal(data, &index); err != nil {
+			log.Printf("Cache index %s is corrupt, starting with an empty disk cache: %v", s.indexPath(), err)
+			index.Entries = nil
+		}
+	}
+
+	// Re-add entries oldest first so eviction order roughly survives
+	keys := make([]string, 0, len(index.Entries))
+	for key, e := range index.Entries {
+		if _, err := os.Stat(s.objectPath(e.File)); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return index.Entries[keys[i]].StoredAt.Before(index.Entries[keys[j]].StoredAt)
+	})
+	referenced := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		e := index.Entries[key]
+		s.entries[key] = e
+		s.bytes += e.Size
+		s.policy.Add(key)
+		referenced[e.File] = true
+	}
+
+	files, err := os.ReadDir(filepath.Join(s.dir, "objects"))
+	if err != nil {
+		return fmt.Errorf("reading cache directory: %w", err)
+	}
+	for _, f := range files {
+		if !referenced[f.Name()] {
+			os.Remove(s.objectPath(f.Name()))
+		}
+	}
+	os.RemoveAll(filepath.Join(s.dir, "tmp"))
+	os.MkdirAll(filepath.Join(s.dir, "tmp"), 0o755)
+
+	// The limits may have shrunk since the index was written
+	s.mu.Lock()
+	var obsolete []string
+	for s.overLimits() {
+		victim, ok := s.policy.Victim()
+		if !ok {
+			break
+		}
+		obsolete = append(obsolete, s.removeLocked(victim))
+	}
+	s.dirty = len(obsolete) > 0 || len(keys) != len(index.Entries)
+	s.mu.Unlock()
+	s.removeFiles(obsolete)
+
+	log.Printf("Disk cache %s: loaded %d entries (%d bytes)", s.dir, len(s.entries), s.bytes)
+	return nil
+}
+
+func (s *DiskStore) Get(key string) *Response {
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	if !ok {
+		s.policy.Miss(key)
+		s.mu.Unlock()
+		return nil
+	}
+	s.policy.Hit(key)
+	meta := *e
+	s.mu.Unlock()
+
+	body, err := os.ReadFile(s.objectPath(meta.File))
+	if err != nil {
+		// Replaced or removed since we looked it up, or lost on disk
+		s.mu.Lock()
+		if cur, ok := s.entries[key]; ok && cur.File == meta.File {
+			s.removeLocked(key)
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	response := meta.response()
+	response.Body = body
+	return response
+}
+
+func (s *DiskStore) Peek(key string) *Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		return e.response()
+	}
+	return nil
+}
+
+func (s *DiskStore) Expire(key string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && at.Before(e.ExpiresAt) {
+		// Get copies entries under the lock, so this is safe to modify
+		e.ExpiresAt = at
+		s.dirty = true
+	}
+}
+
+// Set writes the body to a new file, then swaps it into the index, evicting
+// entries as needed
+func (s *DiskStore) Set(key string, response *Response) bool {
+	size := entrySize(key, response)
+	if s.limits.MaxObjectBytes > 0 && size > s.limits.MaxObjectBytes ||
+		s.limits.MaxBytes > 0 && size > s.limits.MaxBytes {
+		s.mu.Lock()
+		s.rejected++
+		s.mu.Unlock()
+		return false
+	}
+
+	file, err := s.writeObject(key, response.Body)
+	if err != nil {
+		log.Printf("Disk cache write failed: %v", err)
+		return false
+	}
+
+	s.mu.Lock()
+	var obsolete []string
+	// A refresh of an admitted entry isn't put to the policy again, so the
+	// old file is only dropped once the new one is in
+	_, resident := s.entries[key]
+	if resident {
+		obsolete = append(obsolete, s.removeLocked(key))
+	}
+	for s.full(size) {
+		victim, ok := s.policy.Victim()
+		if !ok {
+			break
+		}
+		if !resident && !s.policy.Admit(key, victim) {
+			s.rejected++
+			s.mu.Unlock()
+			s.removeFiles(append(obsolete, file))
+			return false
+		}
+		obsolete = append(obsolete, s.removeLocked(victim))
+		s.evictions++
+	}
+	s.entries[key] = &diskEntry{
+		File:       file,
+		StatusCode: response.StatusCode,
+		Headers:    response.Headers,
+		ExpiresAt:  response.ExpiresAt,
+		StoredAt:   response.StoredAt,
+		InitialAge: response.InitialAge,
+		Shareable:  response.Shareable,
+		Size:       size,
+	}
+	s.bytes += size
+	s.policy.Add(key)
+	s.dirty = true
+	s.mu.Unlock()
+
+	s.removeFiles(obsolete)
+	return true
+}
+
+// writeObject writes body to a uniquely named file, via a temporary file so
+// readers never see a partial body
+func (s *DiskStore) writeObject(key string, body []byte) (string, error) {
+	sum := sha256.Sum256([]byte(key))
+	file := hex.EncodeToString(sum[:16]) + "-" + strconv.FormatInt(s.seq.Add(1), 36) + strconv.FormatInt(time.Now().UnixNano(), 36)
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "object-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), s.objectPath(file)); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return file, nil
+}
+
+// full reports whether adding an entry of size would exceed the limits
+func (s *DiskStore) full(size int64) bool {
+	if s.limits.MaxEntries > 0 && len(s.entries)+1 > s.limits.MaxEntries {
+		return true
+	}
+	return s.limits.MaxBytes > 0 && s.bytes+size > s.limits.MaxBytes
+}
+
+func (s *DiskStore) overLimits() bool {
+	if s.limits.MaxEntries > 0 && len(s.entries) > s.limits.MaxEntries {
+		return true
+	}
+	return s.limits.MaxBytes > 0 && s.bytes > s.limits.MaxBytes
+}
+
+// removeLocked drops key from the index and returns its file, which the
+// caller deletes once the lock is released
+func (s *DiskStore) removeLocked(key string) string {
+	s.policy.Remove(key)
+	e, ok := s.entries[key]
+	if !ok {
+		return ""
+	}
+	s.bytes -= e.Size
+	delete(s.entries, key)
+	s.dirty = true
+	return e.File
+}
+
+func (s *DiskStore) removeFiles(files []string) {
+	for _, f := range files {
+		if f != "" {
+			os.Remove(s.objectPath(f))
+		}
+	}
+}
+
+func (s *DiskStore) Delete(key string) {
+	s.mu.Lock()
+	file := s.removeLocked(key)
+	s.mu.Unlock()
+	s.removeFiles([]string{file})
+}
+
+func (s *DiskStore) Clear() {
+	s.mu.Lock()
+	files := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		files = append(files, s.removeLocked(key))
+	}
+	s.mu.Unlock()
+	s.removeFiles(files)
+}
+
+func (s *DiskStore) RemoveExpired(cutoff time.Time) {
+	s.mu.Lock()
+	var files []string
+	for key, e := range s.entries {
+		if cutoff.After(e.ExpiresAt) {
+			files = append(files, s.removeLocked(key))
+			s.expired++
+		}
+	}
+	s.mu.Unlock()
+	s.removeFiles(files)
+}
+
+func (s *DiskStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func (s *DiskStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s *DiskStore) Stats() []Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []Stats{{
+		Tier:      "disk",
+		Entries:   len(s.entries),
+		Bytes:     s.bytes,
+		Evictions: s.evictions,
+		Expired:   s.expired,
+		Rejected:  s.rejected,
+	}}
+}
+
+func (s *DiskStore) flushLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(indexFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				log.Printf("Disk cache index write failed: %v", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// flush writes the index if it changed, replacing the old one atomically
+func (s *DiskStore) flush() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(diskIndex{Version: 1, Entries: s.entries})
+	s.dirty = false
+	s.mu.Unlock()
+	if err == nil {
+		tmp := s.indexPath() + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, s.indexPath())
+		}
+	}
+	if err != nil {
+		// Try again next time
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Close stops the flush loop and writes the index a final time
+func (s *DiskStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.flush()
+}
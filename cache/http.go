@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directives holds parsed Cache-Control directives, lower-cased, mapped to
+// their (unquoted) argument or "" when they have none
+type Directives map[string]string
+
+// ParseCacheControl parses every Cache-Control header in h
+func ParseCacheControl(h http.Header) Directives {
+	d := make(Directives)
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(part, "=")
+			d[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return d
+}
+
+func (d Directives) Has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// Seconds returns a delta-seconds directive such as max-age as a duration
+func (d Directives) Seconds(name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// RequestDirectives returns the request's Cache-Control, treating a bare
+// Pragma: no-cache as Cache-Control: no-cache for HTTP/1.0 clients
+func RequestDirectives(h http.Header) Directives {
+	d := ParseCacheControl(h)
+	if len(d) == 0 && strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache") {
+		d["no-cache"] = ""
+	}
+	return d
+}
+
+// HasCredentials reports whether the request carries credentials that make
+// the response user-specific
+func HasCredentials(h http.Header) bool {
+	return h.Get("Authorization") != "" || h.Get("Cookie") != ""
+}
+
+// ExplicitlyShareable reports whether a response says a shared cache may
+// store it even for a request with credentials (RFC 9111 section 3.5)
+func ExplicitlyShareable(cc Directives) bool {
+	return cc.Has("public") || cc.Has("s-maxage") || cc.Has("must-revalidate")
+}
+
+// Storable reports whether a shared cache may store the response at all,
+// regardless of status code. perUser says the request's credentials are part
+// of the cache key, so the entry is only ever served back to the same user
+// and the credentials don't stop it from being stored.
+func Storable(reqHeader http.Header, respHeader http.Header, perUser bool) bool {
+	reqCC := RequestDirectives(reqHeader)
+	respCC := ParseCacheControl(respHeader)
+	if reqCC.Has("no-store") || respCC.Has("no-store") || respCC.Has("private") {
+		return false
+	}
+	if respHeader.Get("Set-Cookie") != "" {
+		return false
+	}
+	if _, star := VaryHeaders(respHeader); star {
+		return false
+	}
+	if HasCredentials(reqHeader) && !perUser && !ExplicitlyShareable(respCC) {
+		return false
+	}
+	return true
+}
+
+// FreshnessLifetime returns how long a response is fresh from when it was
+// generated: s-maxage, then max-age, then Expires minus Date, falling back to
+// heuristic when the response gives no explicit lifetime
+func FreshnessLifetime(h http.Header, heuristic time.Duration) time.Duration {
+	cc := ParseCacheControl(h)
+	if d, ok := cc.Seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.Seconds("max-age"); ok {
+		return d
+	}
+	if expires := h.Get("Expires"); expires != "" {
+		exp, err := http.ParseTime(expires)
+		if err != nil {
+			// Invalid Expires (e.g. "0") means already expired
+			return 0
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		if exp.Before(date) {
+			return 0
+		}
+		return exp.Sub(date)
+	}
+	return heuristic
+}
+
+// InitialAge estimates how old a response already is when received, from
+// its Age header and Date
+func InitialAge(h http.Header, receivedAt time.Time) time.Duration {
+	var age time.Duration
+	if v := h.Get("Age"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			age = time.Duration(n) * time.Second
+		}
+	}
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		// Date only has second precision
+		if apparent := receivedAt.Truncate(time.Second).Sub(date); apparent > age {
+			age = apparent
+		}
+	}
+	return age
+}
+
+// VaryHeaders returns the canonical header names listed in Vary, sorted, and
+// whether Vary contains "*" (which means the response can't be reused)
+func VaryHeaders(h http.Header) ([]string, bool) {
+	var names []string
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, true
+			}
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	sort.Strings(names)
+	return names, false
+}
+
+// VariantKey extends a primary cache key with the request's values for the
+// headers a response varies on
+func VariantKey(key string, vary []string, reqHeader http.Header) string {
+	if len(vary) == 0 {
+		return key
+	}
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(reqHeader.Values(name), ","))
+	}
+	return b.String()
+}
+
+// NotModified evaluates a client's If-None-Match, or failing that
+// If-Modified-Since, against a stored response's validators
+func NotModified(reqHeader, respHeader http.Header) bool {
+	if values := reqHeader.Values("If-None-Match"); len(values) > 0 {
+		etag := respHeader.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(strings.Join(values, ","), ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakMatch(candidate, etag) {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(reqHeader.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(respHeader.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
+
+// weakMatch compares entity tags ignoring the weak indicator, as
+// If-None-Match requires
+func weakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// UpdateHeaders returns the stored header updated with the fields of a 304
+// response to a revalidation (RFC 9111 section 3.2), keeping the fields that
+// describe the stored body
+func UpdateHeaders(stored, notModified http.Header) http.Header {
+	updated := stored.Clone()
+	for name, values := range notModified {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding":
+			continue
+		}
+		updated[name] = append([]string(nil), values...)
+	}
+	return updated
+}
+
+// parseVariantKey splits a key built by VariantKey back into the primary key
+// and the header names it varies on
+func parseVariantKey(variant string) (string, []string) {
+	parts := strings.Split(variant, "\x00")
+	var vary []string
+	for _, part := range parts[1:] {
+		name, _, _ := strings.Cut(part, "=")
+		vary = append(vary, name)
+	}
+	return parts[0], vary
+}
+
+// TagHeaders are the response headers a backend lists purge tags in:
+// Surrogate-Key is space separated, Cache-Tag comma separated
+var TagHeaders = []string{"Surrogate-Key", "Cache-Tag"}
+
+// Tags returns the purge tags a response was labelled with
+func Tags(h http.Header) []string {
+	var tags []string
+	for _, name := range TagHeaders {
+		for _, line := range h.Values(name) {
+			tags = append(tags, strings.FieldsFunc(line, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})...)
+		}
+	}
+	return tags
+}
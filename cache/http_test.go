@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// header builds an http.Header from name, value pairs
+func header(pairs ...string) http.Header {
+	h := make(http.Header)
+	for i := 0; i < len(pairs); i += 2 {
+		h.Add(pairs[i], pairs[i+1])
+	}
+	return h
+}
+
+func TestStorable(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     http.Header
+		resp    http.Header
+		perUser bool
+		want    bool
+	}{
+		{"plain", header(), header("Cache-Control", "max-age=60"), false, true},
+		{"request no-store", header("Cache-Control", "no-store"), header(), false, false},
+		{"response no-store", header(), header("Cache-Control", "max-age=60, no-store"), false, false},
+		{"private", header(), header("Cache-Control", "private, max-age=60"), false, false},
+		{"private even per user", header("Authorization", "Bearer a"), header("Cache-Control", "private"), true, false},
+		{"set-cookie", header(), header("Set-Cookie", "id=1"), false, false},
+		{"vary star", header(), header("Vary", "Accept, *"), false, false},
+		{"vary header", header(), header("Vary", "Accept-Encoding"), false, true},
+		{"authorization", header("Authorization", "Bearer a"), header("Cache-Control", "max-age=60"), false, false},
+		{"cookie", header("Cookie", "session=a"), header(), false, false},
+		{"authorization with public", header("Authorization", "Bearer a"), header("Cache-Control", "public"), false, true},
+		{"cookie with s-maxage", header("Cookie", "session=a"), header("Cache-Control", "s-maxage=60"), false, true},
+		{"authorization with must-revalidate", header("Authorization", "Bearer a"), header("Cache-Control", "must-revalidate"), false, true},
+		{"authorization per user", header("Authorization", "Bearer a"), header("Cache-Control", "max-age=60"), true, true},
+	}
+	for _, tt := range tests {
+		if got := Storable(tt.req, tt.resp, tt.perUser); got != tt.want {
+			t.Errorf("%s: Storable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	httpDate := func(t time.Time) string { return t.Format(http.TimeFormat) }
+	heuristic := 7 * time.Second
+	tests := []struct {
+		name string
+		h    http.Header
+		want time.Duration
+	}{
+		{"no lifetime", header(), heuristic},
+		{"max-age", header("Cache-Control", "max-age=60"), time.Minute},
+		{"s-maxage wins", header("Cache-Control", "max-age=60, s-maxage=10"), 10 * time.Second},
+		{"max-age wins over expires", header("Cache-Control", "max-age=60", "Date", httpDate(date), "Expires", httpDate(date.Add(time.Hour))), time.Minute},
+		{"invalid max-age", header("Cache-Control", "max-age=-1"), heuristic},
+		{"expires minus date", header("Date", httpDate(date), "Expires", httpDate(date.Add(time.Hour))), time.Hour},
+		{"expires before date", header("Date", httpDate(date), "Expires", httpDate(date.Add(-time.Hour))), 0},
+		{"invalid expires", header("Date", httpDate(date), "Expires", "0"), 0},
+	}
+	for _, tt := range tests {
+		if got := FreshnessLifetime(tt.h, heuristic); got != tt.want {
+			t.Errorf("%s: FreshnessLifetime = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Without Date, Expires counts from now
+	h := header("Expires", httpDate(time.Now().Add(time.Hour)))
+	if got := FreshnessLifetime(h, heuristic); got < 58*time.Minute || got > time.Hour {
+		t.Errorf("expires without date: FreshnessLifetime = %v, want about 1h", got)
+	}
+}
+
+func TestInitialAge(t *testing.T) {
+	received := time.Date(2024, 5, 1, 12, 0, 30, 500, time.UTC)
+	httpDate := func(t time.Time) string { return t.Format(http.TimeFormat) }
+	tests := []struct {
+		name string
+		h    http.Header
+		want time.Duration
+	}{
+		{"nothing", header(), 0},
+		{"age", header("Age", "100"), 100 * time.Second},
+		{"invalid age", header("Age", "soon"), 0},
+		{"negative age", header("Age", "-5"), 0},
+		{"apparent age", header("Date", httpDate(received.Add(-10*time.Second))), 10 * time.Second},
+		{"apparent age older than age", header("Age", "5", "Date", httpDate(received.Add(-20*time.Second))), 20 * time.Second},
+		{"age older than apparent age", header("Age", "300", "Date", httpDate(received.Add(-20*time.Second))), 300 * time.Second},
+		{"date in the future", header("Date", httpDate(received.Add(time.Minute))), 0},
+	}
+	for _, tt := range tests {
+		if got := InitialAge(tt.h, received); got != tt.want {
+			t.Errorf("%s: InitialAge = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	before := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	after := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	tests := []struct {
+		name string
+		req  http.Header
+		resp http.Header
+		want bool
+	}{
+		{"no conditions", header(), header("ETag", `"a"`), false},
+		{"etag match", header("If-None-Match", `"a"`), header("ETag", `"a"`), true},
+		{"etag mismatch", header("If-None-Match", `"b"`), header("ETag", `"a"`), false},
+		{"weak request etag", header("If-None-Match", `W/"a"`), header("ETag", `"a"`), true},
+		{"weak stored etag", header("If-None-Match", `"a"`), header("ETag", `W/"a"`), true},
+		{"etag in list", header("If-None-Match", `"x", W/"a"`), header("ETag", `"a"`), true},
+		{"etag over several headers", header("If-None-Match", `"x"`, "If-None-Match", `"a"`), header("ETag", `"a"`), true},
+		{"star", header("If-None-Match", "*"), header("ETag", `"a"`), true},
+		{"no stored etag", header("If-None-Match", "*"), header("Last-Modified", modified), false},
+		{"if-none-match wins", header("If-None-Match", `"b"`, "If-Modified-Since", after), header("ETag", `"a"`, "Last-Modified", modified), false},
+		{"not modified since", header("If-Modified-Since", modified), header("Last-Modified", modified), true},
+		{"modified since", header("If-Modified-Since", before), header("Last-Modified", modified), false},
+		{"invalid since", header("If-Modified-Since", "yesterday"), header("Last-Modified", modified), false},
+		{"no last-modified", header("If-Modified-Since", after), header(), false},
+	}
+	for _, tt := range tests {
+		if got := NotModified(tt.req, tt.resp); got != tt.want {
+			t.Errorf("%s: NotModified = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
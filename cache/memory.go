@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Limits bounds what the cache holds. Zero values mean unlimited.
+type Limits struct {
+	MaxEntries int
+	MaxBytes   int64
+	// MaxObjectBytes is the largest single response that will be cached
+	MaxObjectBytes int64
+	// Policy names the eviction policy, see NewPolicy
+	Policy string
+}
+
+// MemoryStore holds entries in memory within Limits, evicting according to
+// its Policy when full
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	policy  Policy
+	limits  Limits
+	bytes   int64
+
+	evictions int64
+	expired   int64
+	rejected  int64
+}
+
+type memoryEntry struct {
+	response *Response
+	size     int64
+}
+
+func NewMemoryStore(limits Limits) (*MemoryStore, error) {
+	policy, err := NewPolicy(limits.Policy, limits.MaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryStore{
+		entries: make(map[string]*memoryEntry),
+		policy:  policy,
+		limits:  limits,
+	}, nil
+}
+
+// entrySize approximates the memory an entry takes
+func entrySize(key string, response *Response) int64 {
+	size := int64(len(key) + len(response.Body))
+	for name, values := range response.Headers {
+		size += int64(len(name))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
+
+func (s *MemoryStore) Get(key string) *Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		s.policy.Miss(key)
+		return nil
+	}
+	s.policy.Hit(key)
+	return e.response
+}
+
+func (s *MemoryStore) Peek(key string) *Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		return e.response
+	}
+	return nil
+}
+
+func (s *MemoryStore) Expire(key string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && at.Before(e.response.ExpiresAt) {
+		// Readers may hold the old response, so replace rather than modify it
+		expired := *e.response
+		expired.ExpiresAt = at
+		e.response = &expired
+	}
+}
+
+// Set stores response, evicting entries as needed. It reports false if the
+// response is too large or the policy declined to admit it.
+func (s *MemoryStore) Set(key string, response *Response) bool {
+	size := entrySize(key, response)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.limits.MaxObjectBytes > 0 && size > s.limits.MaxObjectBytes ||
+		s.limits.MaxBytes > 0 && size > s.limits.MaxBytes {
+		s.rejected++
+		return false
+	}
+	// Replacing an entry frees its space first. The entry was admitted
+	// already, so a refresh isn't put to the policy again: a rejection would
+	// lose content that is still valid.
+	_, resident := s.entries[key]
+	s.removeLocked(key)
+	for s.full(size) {
+		victim, ok := s.policy.Victim()
+		if !ok {
+			break
+		}
+		if !resident && !s.policy.Admit(key, victim) {
+			s.rejected++
+			return false
+		}
+		s.removeLocked(victim)
+		s.evictions++
+	}
+	s.entries[key] = &memoryEntry{response: response, size: size}
+	s.bytes += size
+	s.policy.Add(key)
+	return true
+}
+
+// full reports whether adding an entry of size would exceed the limits
+func (s *MemoryStore) full(size int64) bool {
+	if s.limits.MaxEntries > 0 && len(s.entries)+1 > s.limits.MaxEntries {
+		return true
+	}
+	return s.limits.MaxBytes > 0 && s.bytes+size > s.limits.MaxBytes
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(key)
+}
+
+func (s *MemoryStore) removeLocked(key string) {
+	if e, ok := s.entries[key]; ok {
+		s.bytes -= e.size
+		delete(s.entries, key)
+	}
+	s.policy.Remove(key)
+}
+
+func (s *MemoryStore) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.entries {
+		s.removeLocked(key)
+	}
+}
+
+func (s *MemoryStore) RemoveExpired(cutoff time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, e := range s.entries {
+		if cutoff.After(e.response.ExpiresAt) {
+			s.removeLocked(key)
+			s.expired++
+		}
+	}
+}
+
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func (s *MemoryStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s *MemoryStore) Stats() []Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []Stats{{
+		Tier:      "memory",
+		Entries:   len(s.entries),
+		Bytes:     s.bytes,
+		Evictions: s.evictions,
+		Expired:   s.expired,
+		Rejected:  s.rejected,
+	}}
+}
+
+func (s *MemoryStore) Close() error { return nil }
@@ -0,0 +1,266 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"hash/fnv"
+)
+
+// Policy decides which entry to evict when the cache is full. Stores call it
+// with their lock held, so implementations need not be safe for concurrent
+// use.
+type Policy interface {
+	// Hit records a read of a stored key, Miss a read of a missing one
+	Hit(key string)
+	Miss(key string)
+	Add(key string)
+	Remove(key string)
+	// Victim returns the key to evict next
+	Victim() (string, bool)
+	// Admit reports whether key is worth storing at the cost of evicting
+	// victim. Policies without admission control always admit.
+	Admit(key, victim string) bool
+}
+
+// Eviction policy names accepted by NewPolicy
+const (
+	PolicyLRU     = "lru"
+	PolicyLFU     = "lfu"
+	PolicyTinyLFU = "tinylfu"
+)
+
+// NewPolicy returns the named eviction policy. capacity is the expected
+// number of entries (0 if unknown), used to size TinyLFU's frequency sketch.
+func NewPolicy(name string, capacity int) (Policy, error) {
+	switch name {
+	case "", PolicyLRU:
+		return newLRU(), nil
+	case PolicyLFU:
+		return newLFU(), nil
+	case PolicyTinyLFU:
+		return newTinyLFU(capacity), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q (want %s, %s or %s)", name, PolicyLRU, PolicyLFU, PolicyTinyLFU)
+}
+
+// lru evicts the least recently used entry
+type lru struct {
+	order *list.List // front is most recent
+	items map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (p *lru) Hit(key string) {
+	if e, ok := p.items[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lru) Miss(string) {}
+
+func (p *lru) Add(key string) {
+	if e, ok := p.items[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.items[key] = p.order.PushFront(key)
+}
+
+func (p *lru) Remove(key string) {
+	if e, ok := p.items[key]; ok {
+		p.order.Remove(e)
+		delete(p.items, key)
+	}
+}
+
+func (p *lru) Victim() (string, bool) {
+	e := p.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+func (p *lru) Admit(string, string) bool { return true }
+
+// lfu evicts the least frequently used entry, the least recently used one
+// among equals
+type lfu struct {
+	entries lfuHeap
+	items   map[string]*lfuEntry
+	clock   uint64
+}
+
+type lfuEntry struct {
+	key   string
+	count uint64
+	last  uint64
+	index int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].last < h[j].last
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x any) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *lfuHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newLFU() *lfu {
+	return &lfu{items: make(map[string]*lfuEntry)}
+}
+
+func (p *lfu) Hit(key string) {
+	if e, ok := p.items[key]; ok {
+		p.clock++
+		e.count++
+		e.last = p.clock
+		heap.Fix(&p.entries, e.index)
+	}
+}
+
+func (p *lfu) Miss(string) {}
+
+func (p *lfu) Add(key string) {
+	if _, ok := p.items[key]; ok {
+		p.Hit(key)
+		return
+	}
+	p.clock++
+	e := &lfuEntry{key: key, count: 1, last: p.clock}
+	p.items[key] = e
+	heap.Push(&p.entries, e)
+}
+
+func (p *lfu) Remove(key string) {
+	if e, ok := p.items[key]; ok {
+		heap.Remove(&p.entries, e.index)
+		delete(p.items, key)
+	}
+}
+
+func (p *lfu) Victim() (string, bool) {
+	if len(p.entries) == 0 {
+		return "", false
+	}
+	return p.entries[0].key, true
+}
+
+func (p *lfu) Admit(string, string) bool { return true }
+
+// tinyLFU evicts in LRU order but only admits a new entry if it has been
+// requested more often recently than the entry it would evict, so one-off
+// requests (e.g. a crawler) can't flush popular entries. Frequencies are
+// estimated with a count-min sketch that is halved periodically so old
+// popularity fades.
+type tinyLFU struct {
+	*lru
+	sketch *countMinSketch
+}
+
+func newTinyLFU(capacity int) *tinyLFU {
+	return &tinyLFU{lru: newLRU(), sketch: newCountMinSketch(capacity)}
+}
+
+func (p *tinyLFU) Hit(key string) {
+	p.sketch.increment(key)
+	p.lru.Hit(key)
+}
+
+func (p *tinyLFU) Miss(key string) {
+	p.sketch.increment(key)
+}
+
+func (p *tinyLFU) Admit(key, victim string) bool {
+	return p.sketch.estimate(key) > p.sketch.estimate(victim)
+}
+
+const sketchDepth = 4
+
+type countMinSketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	if capacity <= 0 {
+		capacity = 1 << 16
+	}
+	width := 16
+	for width < capacity {
+		width <<= 1
+	}
+	s := &countMinSketch{mask: uint64(width - 1), resetAt: width * 10}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// indexes derives one counter position per row from two halves of a hash
+func (s *countMinSketch) indexes(key string) [sketchDepth]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+func (s *countMinSketch) increment(key string) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < 255 {
+			s.rows[i][j]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.halve()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	min := uint8(255)
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < min {
+			min = s.rows[i][j]
+		}
+	}
+	return min
+}
+
+func (s *countMinSketch) halve() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
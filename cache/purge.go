@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PurgeSelector picks the entries a purge applies to. An entry is selected
+// if it matches any of the criteria. Keys, prefixes and globs are matched
+// against the full cache key ("route|/path?query", followed by any headers
+// or cookies the route's cache_key adds), the key without those additions,
+// and its URL part, and cover every Vary variant of a matching entry.
+type PurgeSelector struct {
+	Keys     []string
+	Prefixes []string
+	// Globs use * for any run of characters (including /) and ? for one
+	Globs []string
+	// Tags match the backend's Surrogate-Key or Cache-Tag response headers
+	Tags []string
+}
+
+// Purge invalidates the selected entries and returns how many there were. A
+// hard purge deletes them; a soft purge marks them expired, so they are
+// revalidated (or served stale where allowed) on next use instead of
+// refetched in full.
+func (m *Manager) Purge(sel PurgeSelector, soft bool) int {
+	globs := make([]*regexp.Regexp, len(sel.Globs))
+	for i, glob := range sel.Globs {
+		globs[i] = compileGlob(glob)
+	}
+	tags := make(map[string]bool, len(sel.Tags))
+	for _, tag := range sel.Tags {
+		tags[tag] = true
+	}
+
+	now := time.Now()
+	purged := 0
+	for _, key := range m.store.Keys() {
+		primary, _ := parseVariantKey(key)
+		routeURL, _, _ := strings.Cut(primary, " ")
+		_, url, _ := strings.Cut(routeURL, "|")
+		matched := false
+		for _, k := range sel.Keys {
+			matched = matched || k == primary || k == routeURL || k == url
+		}
+		for _, prefix := range sel.Prefixes {
+			matched = matched || strings.HasPrefix(primary, prefix) || strings.HasPrefix(url, prefix)
+		}
+		for _, glob := range globs {
+			matched = matched || glob.MatchString(primary) || glob.MatchString(routeURL) || glob.MatchString(url)
+		}
+		if !matched && len(tags) > 0 {
+			if response := m.store.Peek(key); response != nil {
+				for _, tag := range Tags(http.Header(response.Headers)) {
+					matched = matched || tags[tag]
+				}
+			}
+		}
+		if !matched {
+			continue
+		}
+		if soft {
+			m.store.Expire(key, now)
+		} else {
+			m.store.Delete(key)
+		}
+		purged++
+	}
+	return purged
+}
+
+// compileGlob turns a purge glob into an anchored regexp
+func compileGlob(glob string) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	return regexp.MustCompile("^" + pattern + "$")
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Store holds cache entries by key. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Get returns the entry for key, expired or not, or nil
+	Get(key string) *Response
+	// Peek is Get without counting as a use of the entry. The disk store
+	// leaves Body nil.
+	Peek(key string) *Response
+	// Set stores response under key, reporting false if it wasn't stored
+	// (too large, or not admitted by the eviction policy)
+	Set(key string, response *Response) bool
+	// Expire moves the entry's expiry back to at, keeping it stored
+	Expire(key string, at time.Time)
+	Delete(key string)
+	Clear()
+	// RemoveExpired drops entries that expired before cutoff
+	RemoveExpired(cutoff time.Time)
+	Len() int
+	Keys() []string
+	// Stats returns one entry per storage tier
+	Stats() []Stats
+	Close() error
+}
+
+// TieredStore keeps every entry on disk and the hot ones in memory. Entries
+// are written to both tiers; a disk hit is promoted back into memory.
+type TieredStore struct {
+	memory     Store
+	disk       Store
+	promotions atomic.Int64
+}
+
+func NewTieredStore(memory, disk Store) *TieredStore {
+	return &TieredStore{memory: memory, disk: disk}
+}
+
+func (t *TieredStore) Get(key string) *Response {
+	if response := t.memory.Get(key); response != nil {
+		return response
+	}
+	response := t.disk.Get(key)
+	if response != nil && t.memory.Set(key, response) {
+		t.promotions.Add(1)
+	}
+	return response
+}
+
+func (t *TieredStore) Set(key string, response *Response) bool {
+	onDisk := t.disk.Set(key, response)
+	inMemory := t.memory.Set(key, response)
+	return onDisk || inMemory
+}
+
+func (t *TieredStore) Peek(key string) *Response {
+	if response := t.memory.Peek(key); response != nil {
+		return response
+	}
+	return t.disk.Peek(key)
+}
+
+func (t *TieredStore) Expire(key string, at time.Time) {
+	t.memory.Expire(key, at)
+	t.disk.Expire(key, at)
+}
+
+func (t *TieredStore) Delete(key string) {
+	t.memory.Delete(key)
+	t.disk.Delete(key)
+}
+
+func (t *TieredStore) Clear() {
+	t.memory.Clear()
+	t.disk.Clear()
+}
+
+func (t *TieredStore) RemoveExpired(cutoff time.Time) {
+	t.memory.RemoveExpired(cutoff)
+	t.disk.RemoveExpired(cutoff)
+}
+
+// Len reports the disk tier, which holds nearly every entry
+func (t *TieredStore) Len() int {
+	return t.disk.Len()
+}
+
+// Keys includes the few entries only in memory, e.g. ones the disk tier's
+// policy declined to admit
+func (t *TieredStore) Keys() []string {
+	keys := t.disk.Keys()
+	onDisk := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		onDisk[key] = true
+	}
+	for _, key := range t.memory.Keys() {
+		if !onDisk[key] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (t *TieredStore) Stats() []Stats {
+	stats := append(t.memory.Stats(), t.disk.Stats()...)
+	stats[0].Promotions = t.promotions.Load()
+	return stats
+}
+
+func (t *TieredStore) Close() error {
+	t.memory.Close()
+	return t.disk.Close()
+}
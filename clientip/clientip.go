@@ -0,0 +1,220 @@
+// Package clientip finds the address of the client behind any trusted
+// proxies, from X-Forwarded-For, Forwarded (RFC 7239), X-Real-IP or a PROXY
+// protocol header
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Header names accepted in Resolver's header list
+const (
+	HeaderXForwardedFor = "x-forwarded-for"
+	HeaderForwarded     = "forwarded"
+	HeaderXRealIP       = "x-real-ip"
+)
+
+// DefaultHeaders is the order headers are consulted in when none is given
+var DefaultHeaders = []string{HeaderXForwardedFor, HeaderForwarded, HeaderXRealIP}
+
+// Resolver determines client addresses. Forwarding headers are only
+// believed when the request comes from a trusted proxy, and chains of them
+// are walked from the right, skipping trusted hops, so a client can't
+// prepend a fake address.
+type Resolver struct {
+	trusted []netip.Prefix
+	headers []string
+}
+
+// New creates a resolver trusting the given CIDRs (or single addresses) and
+// reading the given headers in order
+func New(trustedProxies, headers []string) (*Resolver, error) {
+	r := &Resolver{headers: DefaultHeaders}
+	for _, s := range trustedProxies {
+		prefix, err := ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		r.trusted = append(r.trusted, prefix)
+	}
+	if len(headers) > 0 {
+		r.headers = make([]string, len(headers))
+		for i, h := range headers {
+			r.headers[i] = strings.ToLower(h)
+		}
+	}
+	return r, nil
+}
+
+// ParsePrefix parses a CIDR such as "10.0.0.0/8", or a single address
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid trusted proxy %q: %v", s, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid trusted proxy %q: %v", s, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Trusted reports whether addr belongs to a trusted proxy
+func (r *Resolver) Trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedPeer reports whether the connection a request arrived on comes
+// from a trusted proxy
+func (r *Resolver) TrustedPeer(req *http.Request) bool {
+	peer, ok := parseAddr(req.RemoteAddr)
+	return ok && r.Trusted(peer)
+}
+
+// ClientIP returns the address of the client that sent req
+func (r *Resolver) ClientIP(req *http.Request) string {
+	peer, ok := parseAddr(req.RemoteAddr)
+	if !ok {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err == nil && host != "" {
+			return host
+		}
+		return req.RemoteAddr
+	}
+	if !r.Trusted(peer) {
+		return peer.String()
+	}
+	for _, name := range r.headers {
+		if chain := forwardedChain(req.Header, name); len(chain) > 0 {
+			return r.walk(chain, peer).String()
+		}
+	}
+	return peer.String()
+}
+
+// walk goes through chain from the nearest hop and returns the first
+// address not belonging to a trusted proxy. An entry that isn't an address
+// ends the walk at the hop that added it.
+func (r *Resolver) walk(chain []string, peer netip.Addr) netip.Addr {
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseAddr(chain[i])
+		if !ok {
+			return client
+		}
+		client = addr
+		if !r.Trusted(addr) {
+			return addr
+		}
+	}
+	return client
+}
+
+// forwardedChain returns the addresses listed in the named header, oldest
+// first
+func forwardedChain(h http.Header, name string) []string {
+	switch name {
+	case HeaderXForwardedFor:
+		var chain []string
+		for _, line := range h.Values("X-Forwarded-For") {
+			for _, entry := range strings.Split(line, ",") {
+				if entry = strings.TrimSpace(entry); entry != "" {
+					chain = append(chain, entry)
+				}
+			}
+		}
+		return chain
+	case HeaderForwarded:
+		return forwardedFor(h.Values("Forwarded"))
+	case HeaderXRealIP:
+		if ip := strings.TrimSpace(h.Get("X-Real-IP")); ip != "" {
+			return []string{ip}
+		}
+	}
+	return nil
+}
+
+// forwardedFor extracts the for= parameter of each Forwarded element. An
+// element without one yields "" so the walk stops there.
+func forwardedFor(lines []string) []string {
+	var chain []string
+	for _, line := range lines {
+		for _, element := range splitQuoted(line, ',') {
+			node := ""
+			for _, pair := range splitQuoted(element, ';') {
+				name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(name, "for") {
+					node = strings.Trim(value, `"`)
+				}
+			}
+			chain = append(chain, node)
+		}
+	}
+	return chain
+}
+
+// splitQuoted splits s at sep outside of double quotes
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseAddr parses an address with or without a port, IPv6 optionally in
+// brackets: "192.0.2.1", "192.0.2.1:80", "[2001:db8::1]:80", "2001:db8::1"
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); err == nil {
+		return addr.Unmap(), true
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			return addr.Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// ForwardedElement formats an RFC 7239 Forwarded element for a request
+// received from addr
+func ForwardedElement(addr, host, proto string) string {
+	node := `"unknown"`
+	if ip, ok := parseAddr(addr); ok {
+		node = ip.String()
+		if ip.Is6() {
+			node = `"[` + node + `]"`
+		}
+	}
+	element := "for=" + node
+	if host != "" {
+		element += `;host="` + strings.ReplaceAll(host, `"`, "") + `"`
+	}
+	return element + ";proto=" + proto
+}
@@ -0,0 +1,95 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "2001:db8:ffff::/48", "192.0.2.10"}
+	tests := []struct {
+		name    string
+		remote  string
+		headers []string
+		order   []string // header order, DefaultHeaders if nil
+		want    string
+	}{
+		{name: "direct", remote: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "untrusted peer can't spoof", remote: "203.0.113.5:1234", headers: []string{"X-Forwarded-For", "1.1.1.1"}, want: "203.0.113.5"},
+		{name: "untrusted peer can't spoof Forwarded", remote: "203.0.113.5:1234", headers: []string{"Forwarded", "for=1.1.1.1"}, want: "203.0.113.5"},
+		{name: "trusted peer without headers", remote: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "one hop", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "198.51.100.7"}, want: "198.51.100.7"},
+		{name: "trusted hops skipped", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "198.51.100.7, 10.0.0.3, 192.0.2.10"}, want: "198.51.100.7"},
+		{name: "prepended address ignored", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "6.6.6.6, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "untrusted hop stops the walk", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "198.51.100.7, 203.0.113.9, 10.0.0.3"}, want: "203.0.113.9"},
+		{name: "every hop trusted", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "10.0.0.4, 10.0.0.3"}, want: "10.0.0.4"},
+		{name: "several headers", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "6.6.6.6", "X-Forwarded-For", "198.51.100.7, 10.0.0.3"}, want: "198.51.100.7"},
+		{name: "garbage ends the walk", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "198.51.100.7, bogus, 10.0.0.3"}, want: "10.0.0.3"},
+		{name: "garbage from the peer", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "198.51.100.7, bogus"}, want: "10.0.0.1"},
+		{name: "address with port", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "198.51.100.7:5555"}, want: "198.51.100.7"},
+		{name: "ipv6 hop", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "2001:db8::7, 2001:db8:ffff::1"}, want: "2001:db8::7"},
+		{name: "ipv6 peer", remote: "[2001:db8:ffff::2]:443", headers: []string{"X-Forwarded-For", "198.51.100.7"}, want: "198.51.100.7"},
+		{name: "ipv4-mapped peer", remote: "[::ffff:10.0.0.1]:443", headers: []string{"X-Forwarded-For", "198.51.100.7"}, want: "198.51.100.7"},
+		{name: "ipv4-mapped hop", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "::ffff:198.51.100.7"}, want: "198.51.100.7"},
+		{name: "forwarded", remote: "10.0.0.1:1234", headers: []string{"Forwarded", "for=198.51.100.7;proto=https, for=10.0.0.3"}, want: "198.51.100.7"},
+		{name: "forwarded ipv6 with port", remote: "10.0.0.1:1234", headers: []string{"Forwarded", `for="[2001:db8::7]:4711";host="a,b"`}, want: "2001:db8::7"},
+		{name: "forwarded case and spacing", remote: "10.0.0.1:1234", headers: []string{"Forwarded", "proto=http; For=198.51.100.7"}, want: "198.51.100.7"},
+		{name: "forwarded obfuscated", remote: "10.0.0.1:1234", headers: []string{"Forwarded", "for=198.51.100.7, for=_hidden"}, want: "10.0.0.1"},
+		{name: "forwarded element without for", remote: "10.0.0.1:1234", headers: []string{"Forwarded", "for=198.51.100.7, proto=https"}, want: "10.0.0.1"},
+		{name: "x-forwarded-for before forwarded", remote: "10.0.0.1:1234", headers: []string{"Forwarded", "for=198.51.100.8", "X-Forwarded-For", "198.51.100.7"}, want: "198.51.100.7"},
+		{name: "x-real-ip", remote: "10.0.0.1:1234", headers: []string{"X-Real-IP", "198.51.100.7"}, want: "198.51.100.7"},
+		{name: "x-real-ip from a trusted address", remote: "10.0.0.1:1234", headers: []string{"X-Real-IP", "10.0.0.9"}, want: "10.0.0.9"},
+		{name: "configured order", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "198.51.100.7", "X-Real-IP", "198.51.100.8"}, order: []string{"X-Real-IP"}, want: "198.51.100.8"},
+		{name: "unlisted header ignored", remote: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "198.51.100.7"}, order: []string{"forwarded"}, want: "10.0.0.1"},
+		{name: "remote without port", remote: "10.0.0.1", headers: []string{"X-Forwarded-For", "198.51.100.7"}, want: "198.51.100.7"},
+		{name: "unparsable remote", remote: "@", want: "@"},
+	}
+	for _, tt := range tests {
+		r, err := New(trusted, tt.order)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		for i := 0; i < len(tt.headers); i += 2 {
+			req.Header.Add(tt.headers[i], tt.headers[i+1])
+		}
+		if got := r.ClientIP(req); got != tt.want {
+			t.Errorf("%s: ClientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, s := range []string{"10.0.0.0/33", "not an address", "10.0.0.1/"} {
+		if _, err := New([]string{s}, nil); err == nil {
+			t.Errorf("New(%q): want an error", s)
+		}
+	}
+	r, err := New([]string{" 10.1.2.3/8 ", "::ffff:192.0.2.1"}, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for addr, want := range map[string]bool{"10.200.0.1": true, "11.0.0.1": false, "192.0.2.1": true, "[::ffff:192.0.2.1]:80": true, "192.0.2.2": false} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		if got := r.TrustedPeer(req); got != want {
+			t.Errorf("TrustedPeer(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestForwardedElement(t *testing.T) {
+	tests := []struct {
+		addr, host, proto, want string
+	}{
+		{"192.0.2.1:1234", "example.com", "https", `for=192.0.2.1;host="example.com";proto=https`},
+		{"[2001:db8::1]:1234", "", "http", `for="[2001:db8::1]";proto=http`},
+		{"@", `ev"il`, "http", `for="unknown";host="evil";proto=http`},
+	}
+	for _, tt := range tests {
+		if got := ForwardedElement(tt.addr, tt.host, tt.proto); got != tt.want {
+			t.Errorf("ForwardedElement(%q, %q, %q) = %q, want %q", tt.addr, tt.host, tt.proto, got, tt.want)
+		}
+	}
+}
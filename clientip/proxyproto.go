@@ -0,0 +1,186 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2Signature starts every PROXY protocol v2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLength is the longest possible v1 header line, CRLF included
+const v1MaxLength = 107
+
+// Listener wraps a listener whose trusted peers, load balancers speaking
+// the PROXY protocol (v1 or v2), send a header with the original client
+// address before any data. Their connections report that address as
+// RemoteAddr; connections from other peers are served as they are.
+type Listener struct {
+	net.Listener
+	// Trusted reports whether a peer must send a PROXY header
+	Trusted func(netip.Addr) bool
+	// Timeout bounds how long reading the header may take
+	Timeout time.Duration
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peer, ok := parseAddr(conn.RemoteAddr().String())
+	if !ok || !l.Trusted(peer) {
+		return conn, nil
+	}
+	// The header is read on first use, in the connection's own goroutine,
+	// so a slow peer can't hold up Accept
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.Timeout}, nil
+}
+
+// proxyConn is a connection that starts with a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	source net.Addr // nil for a LOCAL or UNKNOWN header
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.source, c.err = readProxyHeader(c.reader)
+		if c.err != nil {
+			c.err = fmt.Errorf("PROXY protocol header from %s: %w", c.Conn.RemoteAddr(), c.err)
+			log.Printf("Closing connection: %v", c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address from the header
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header and returns the source address it
+// carries, or nil if it carries none (LOCAL connections, health checks)
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Both headers are longer than the v2 signature
+	start, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, v2Signature):
+		return readV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readV1(r)
+	}
+	return nil, errors.New("missing header")
+}
+
+// readV1 parses "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source address: %v", err)
+	}
+	if addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("v1 source address %s doesn't match %s", addr, fields[1])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port: %v", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readV2 parses the binary header: signature, version and command, address
+// family and protocol, length, then the addresses
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL: the proxy's own connection, e.g. a health check
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", header[12]&0x0f)
+	}
+
+	switch header[13] >> 4 {
+	case 0x1: // IPv4: source, destination, source port, destination port
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		addr := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 0x2: // IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		addr := netip.AddrFrom16([16]byte(body[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[32:34]))), nil
+	}
+	// Unix sockets and unspecified families carry no usable address
+	return nil, nil
+}
@@ -0,0 +1,151 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v2Header builds a v2 header with the given version and command byte,
+// family and protocol byte, and address block
+func v2Header(verCmd, famProto byte, block []byte) []byte {
+	h := append([]byte(nil), v2Signature...)
+	h = append(h, verCmd, famProto, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(block)))
+	return append(h, block...)
+}
+
+func v2IPv4(src, dst string, srcPort, dstPort uint16) []byte {
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	block := append(s[:], d[:]...)
+	block = binary.BigEndian.AppendUint16(block, srcPort)
+	return binary.BigEndian.AppendUint16(block, dstPort)
+}
+
+func v2IPv6(src, dst string, srcPort, dstPort uint16) []byte {
+	s, d := netip.MustParseAddr(src).As16(), netip.MustParseAddr(dst).As16()
+	block := append(s[:], d[:]...)
+	block = binary.BigEndian.AppendUint16(block, srcPort)
+	return binary.BigEndian.AppendUint16(block, dstPort)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string // source address, "" for none
+		err  bool
+	}{
+		{name: "v1 tcp4", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), want: "192.0.2.1:56324"},
+		{name: "v1 tcp6", in: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4711 443\r\n"), want: "[2001:db8::1]:4711"},
+		{name: "v1 unknown", in: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 unknown with addresses", in: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")},
+		{name: "v1 longest", in: []byte("PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"), want: "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535"},
+		{name: "v1 too long", in: []byte("PROXY UNKNOWN" + strings.Repeat(" ", 100) + "\r\n"), err: true},
+		{name: "v1 missing CR", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), err: true},
+		{name: "v1 truncated", in: []byte("PROXY TCP4 192.0.2.1 198.5"), err: true},
+		{name: "v1 unknown protocol", in: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"), err: true},
+		{name: "v1 missing field", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), err: true},
+		{name: "v1 bad address", in: []byte("PROXY TCP4 192.0.2.300 198.51.100.1 56324 443\r\n"), err: true},
+		{name: "v1 bad port", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"), err: true},
+		{name: "v1 family mismatch", in: []byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n"), err: true},
+		{name: "v1 tcp6 with ipv4", in: []byte("PROXY TCP6 192.0.2.1 2001:db8::2 56324 443\r\n"), err: true},
+		{name: "v2 ipv4", in: v2Header(0x21, 0x11, v2IPv4("192.0.2.1", "198.51.100.1", 56324, 443)), want: "192.0.2.1:56324"},
+		{name: "v2 ipv6", in: v2Header(0x21, 0x21, v2IPv6("2001:db8::1", "2001:db8::2", 4711, 443)), want: "[2001:db8::1]:4711"},
+		{name: "v2 ipv4 with TLVs", in: v2Header(0x21, 0x11, append(v2IPv4("192.0.2.1", "198.51.100.1", 1, 2), 0x04, 0, 1, 'x')), want: "192.0.2.1:1"},
+		{name: "v2 local", in: v2Header(0x20, 0x11, v2IPv4("192.0.2.1", "198.51.100.1", 1, 2))},
+		{name: "v2 local without addresses", in: v2Header(0x20, 0x00, nil)},
+		{name: "v2 unspecified family", in: v2Header(0x21, 0x00, nil)},
+		{name: "v2 unix", in: v2Header(0x21, 0x31, make([]byte, 216))},
+		{name: "v2 unknown family", in: v2Header(0x21, 0x41, make([]byte, 8))},
+		{name: "v2 version 1", in: v2Header(0x11, 0x11, v2IPv4("192.0.2.1", "198.51.100.1", 1, 2)), err: true},
+		{name: "v2 unknown command", in: v2Header(0x22, 0x11, v2IPv4("192.0.2.1", "198.51.100.1", 1, 2)), err: true},
+		{name: "v2 short ipv4 block", in: v2Header(0x21, 0x11, make([]byte, 8)), err: true},
+		{name: "v2 short ipv6 block", in: v2Header(0x21, 0x21, make([]byte, 20)), err: true},
+		{name: "v2 truncated header", in: v2Header(0x21, 0x11, nil)[:14], err: true},
+		{name: "v2 truncated addresses", in: v2Header(0x21, 0x11, v2IPv4("192.0.2.1", "198.51.100.1", 1, 2))[:20], err: true},
+		{name: "no header", in: []byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"), err: true},
+		{name: "empty", in: nil, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The request that follows must be left unread
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.in), strings.NewReader("GET")))
+			addr, err := readProxyHeader(r)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %v, want an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("source = %q, want %q", got, tt.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "GET" {
+				t.Errorf("left %q after the header, want %q", rest, "GET")
+			}
+		})
+	}
+}
+
+// Trusted peers' connections report the header's source; other peers are
+// served as they are, header and all
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := true
+	l := &Listener{Listener: inner, Trusted: func(netip.Addr) bool { return trusted }, Timeout: time.Second}
+	defer l.Close()
+
+	send := func(data string) (remote, body string) {
+		t.Helper()
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Write([]byte(data))
+		client.(*net.TCPConn).CloseWrite()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		read, _ := io.ReadAll(conn)
+		return conn.RemoteAddr().String(), string(read)
+	}
+
+	remote, body := send("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello")
+	if remote != "192.0.2.1:56324" || body != "hello" {
+		t.Errorf("trusted v1: RemoteAddr %q, body %q", remote, body)
+	}
+	remote, body = send(string(v2Header(0x20, 0x00, nil)) + "hello")
+	if !strings.HasPrefix(remote, "127.0.0.1:") || body != "hello" {
+		t.Errorf("trusted v2 LOCAL: RemoteAddr %q, body %q", remote, body)
+	}
+	remote, body = send("hello")
+	if body != "" {
+		t.Errorf("trusted peer without a header: read %q (RemoteAddr %q), want the connection closed", body, remote)
+	}
+
+	trusted = false
+	remote, body = send("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello")
+	if !strings.HasPrefix(remote, "127.0.0.1:") || !strings.HasPrefix(body, "PROXY ") {
+		t.Errorf("untrusted peer: RemoteAddr %q, body %q; want its own address and the header passed through", remote, body)
+	}
+}
@@ -0,0 +1,1194 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration wraps time.Duration so it can be written as "30s" in JSON
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\" or \"5m\", got %s", string(data))
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	d.Duration = parsed
+	return nil
+}
+
+type Config struct {
+	Server    ServerConfig     `json:"server"`
+	Backend   BackendConfig    `json:"backend"`
+	Cache     CacheConfig      `json:"cache"`
+	RateLimit RateLimitConfig  `json:"rate_limit"`
+	Metrics   MetricsConfig    `json:"metrics"`
+	Logging   LoggingConfig    `json:"logging"`
+	Reload    ReloadConfig     `json:"reload"`
+	Admin     AdminConfig      `json:"admin"`
+	Upstreams []UpstreamConfig `json:"upstreams"`
+	Routes    []RouteConfig    `json:"routes"`
+	// RetryBudget caps retries across all routes
+	RetryBudget RetryBudgetConfig `json:"retry_budget"`
+	ClientIP    ClientIPConfig    `json:"client_ip"`
+}
+
+type ServerConfig struct {
+	Port         int      `json:"port"`
+	ReadTimeout  Duration `json:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout"`
+	IdleTimeout  Duration `json:"idle_timeout"`
+	// DrainDelay is how long /health reports draining before the listener
+	// closes, giving load balancers time to stop sending traffic
+	DrainDelay Duration `json:"drain_delay"`
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// before remaining connections are force-closed
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+type BackendConfig struct {
+	URL                 string   `json:"url"`
+	HealthCheckPath     string   `json:"health_check_path"`
+	HealthCheckInterval Duration `json:"health_check_interval"`
+}
+
+type CacheConfig struct {
+	TTL Duration `json:"ttl"`
+	// MaxSize caps the number of entries, MaxBytes their total size and
+	// MaxObjectBytes the size of a single response (0 means unlimited)
+	MaxSize        int   `json:"max_size"`
+	MaxBytes       int64 `json:"max_bytes"`
+	MaxObjectBytes int64 `json:"max_object_bytes"`
+	// EvictionPolicy picks what to drop when full: lru (default), lfu or
+	// tinylfu (LRU with frequency-based admission)
+	EvictionPolicy  string   `json:"eviction_policy"`
+	CleanupInterval Duration `json:"cleanup_interval"`
+	// StaleRetention is how long expired entries are kept so they can be
+	// revalidated with the backend instead of refetched
+	StaleRetention Duration `json:"stale_retention"`
+	// StaleWhileRevalidate and StaleIfError are the RFC 5861 windows used
+	// when the backend doesn't send its own; 0 serves stale only when it does
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate"`
+	StaleIfError         Duration `json:"stale_if_error"`
+	// CoalesceTimeout is how long a request waits for an identical fetch
+	// already in progress before going to the backend itself; 0 disables
+	// coalescing
+	CoalesceTimeout Duration `json:"coalesce_timeout"`
+	// StatusTTL caches responses with other status codes than 200, see
+	// RouteConfig.StatusTTL. Routes add to or override these rules.
+	StatusTTL map[string]Duration `json:"status_ttl"`
+	// Store is memory (default), disk, or tiered (hot entries in memory,
+	// everything on disk)
+	Store string          `json:"store"`
+	Disk  DiskCacheConfig `json:"disk"`
+	Warm  WarmConfig      `json:"warm"`
+}
+
+// DiskCacheConfig configures the disk store, which keeps its index across
+// restarts. max_object_bytes and eviction_policy are shared with memory.
+type DiskCacheConfig struct {
+	Path     string `json:"path"`
+	MaxSize  int    `json:"max_size"`
+	MaxBytes int64  `json:"max_bytes"`
+}
+
+// WarmConfig pre-populates the cache by requesting URLs through the proxy.
+// URLs may be absolute (their host is sent as Host) or paths; either way
+// Prefix is prepended to the path, e.g. "/proxy" for the default route.
+type WarmConfig struct {
+	URLs []string `json:"urls"`
+	// URLList is a file with one URL per line
+	URLList string `json:"url_list"`
+	// Sitemap is a sitemap.xml (or sitemap index) file, or an http(s) URL
+	// fetched through the proxy like the URLs it lists
+	Sitemap     string            `json:"sitemap"`
+	Prefix      string            `json:"prefix"`
+	Headers     map[string]string `json:"headers"`
+	Concurrency int               `json:"concurrency"`
+	// OnStart warms the cache from the sources above at startup
+	OnStart bool `json:"on_start"`
+	// Hot URLs are refetched when their entry is missing or within
+	// RefreshBefore of expiring, checked every CheckInterval
+	Hot           []string `json:"hot"`
+	RefreshBefore Duration `json:"refresh_before"`
+	CheckInterval Duration `json:"check_interval"`
+}
+
+// ObjectLimit returns the largest response body worth buffering for the
+// cache: max_object_bytes, or max_bytes if that is smaller (0 means no limit)
+func (c CacheConfig) ObjectLimit() int64 {
+	limit := c.MaxObjectBytes
+	if c.MaxBytes > 0 && (limit == 0 || c.MaxBytes < limit) {
+		limit = c.MaxBytes
+	}
+	return limit
+}
+
+// Retention returns how long expired entries are kept: long enough to be
+// revalidated and to be served within the stale windows
+func (c CacheConfig) Retention() time.Duration {
+	retention := c.StaleRetention.Duration
+	for _, d := range []time.Duration{c.StaleWhileRevalidate.Duration, c.StaleIfError.Duration} {
+		if d > retention {
+			retention = d
+		}
+	}
+	return retention
+}
+
+type RateLimitConfig struct {
+	RequestsPerMinute int `json:"requests_per_minute"`
+	// BurstSize is how many requests may arrive at once (token_bucket and
+	// gcra); 0 allows a full minute's worth
+	BurstSize int `json:"burst_size"`
+	// Algorithm is token_bucket (default), gcra or sliding_window
+	Algorithm       string   `json:"algorithm"`
+	CleanupInterval Duration `json:"cleanup_interval"`
+	// Headers selects the quota headers sent on every response: separate
+	// (default: RateLimit-Limit, -Remaining, -Reset and RateLimit-Policy),
+	// combined (RateLimit and RateLimit-Policy) or none
+	Headers string `json:"headers"`
+	// ErrorFormat is the format of 429 bodies: text (default), json or html.
+	// ErrorBody replaces the built-in body; {policy}, {limit}, {remaining},
+	// {reset} and {retry_after} in it are filled in.
+	ErrorFormat string `json:"error_format"`
+	ErrorBody   string `json:"error_body"`
+	// Policies replace the single per-IP limit above with limits keyed by
+	// API key, JWT claim, route and so on. A request must pass every policy
+	// that applies to it.
+	Policies []RateLimitPolicyConfig `json:"policies"`
+	// Store shares the counts between goproxy instances
+	Store RateLimitStoreConfig `json:"store"`
+}
+
+// RateLimitStoreConfig selects where rate limit counts are kept. With the
+// default memory store each instance counts on its own, so N instances allow
+// N times the limit.
+type RateLimitStoreConfig struct {
+	// Type is memory (default) or redis
+	Type string `json:"type"`
+	// URL is redis://[[user]:password@]host[:port][/db], or rediss:// for TLS
+	URL      string `json:"url"`
+	Prefix   string `json:"prefix"`
+	PoolSize int    `json:"pool_size"`
+	// Timeout bounds each call to the store
+	Timeout Duration `json:"timeout"`
+	// Mode is exact (default), a call to the store per request, or
+	// approximate, counting locally and syncing every SyncInterval
+	Mode         string   `json:"mode"`
+	SyncInterval Duration `json:"sync_interval"`
+	// RetryInterval is how long to count locally after the store fails
+	RetryInterval Duration `json:"retry_interval"`
+}
+
+// RateLimitPolicyConfig is one rate limit, counted per distinct key
+type RateLimitPolicyConfig struct {
+	Name string `json:"name"`
+	// Key lists what the key is built from: ip, route, header:<Name>,
+	// query:<name>, cookie:<name> or jwt:<claim>. Requests missing any part
+	// skip the policy.
+	Key []string `json:"key"`
+	// Routes limits the policy to the named routes; empty means all
+	Routes []string `json:"routes"`
+	Limit  int      `json:"limit"`
+	// Window defaults to 1m
+	Window Duration `json:"window"`
+	// Burst defaults to Limit
+	Burst int `json:"burst"`
+	// Algorithm defaults to rate_limit.algorithm
+	Algorithm string `json:"algorithm"`
+}
+
+type MetricsConfig struct {
+	Enabled         bool     `json:"enabled"`
+	Path            string   `json:"path"`
+	RetentionPeriod Duration `json:"retention_period"`
+}
+
+type LoggingConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+	Output string `json:"output"`
+}
+
+// UpstreamConfig names a backend that routes can forward to. backend.url is
+// always available as the upstream named "default".
+type UpstreamConfig struct {
+	Name string `json:"name"`
+	// URL is shorthand for a single target with weight 1
+	URL     string         `json:"url"`
+	Targets []TargetConfig `json:"targets"`
+	// LoadBalancer is round_robin (default), weighted_round_robin,
+	// least_connections, random_two_choices or consistent_hash
+	LoadBalancer string `json:"load_balancer"`
+	// HashKey selects what consistent_hash hashes: client_ip (default) or
+	// header:<Name>
+	HashKey        string                `json:"hash_key"`
+	HealthCheck    *HealthCheckConfig    `json:"health_check"`
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker"`
+}
+
+// CircuitBreakerConfig enables failing fast while an upstream is failing.
+// Zero values fall back to the defaults noted on each field.
+type CircuitBreakerConfig struct {
+	// ConsecutiveFailures (connection errors, 5xx, slow responses) that open
+	// the circuit, default 5
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// LatencyThreshold counts slower responses as failures, 0 disables
+	LatencyThreshold Duration `json:"latency_threshold"`
+	// OpenDuration before probing the upstream again, default 30s
+	OpenDuration Duration `json:"open_duration"`
+	// HalfOpenRequests probes allowed at once while half-open, default 1
+	HalfOpenRequests int `json:"half_open_requests"`
+	// FailStatus and FailBody are returned while open, default 503
+	FailStatus int    `json:"fail_status"`
+	FailBody   string `json:"fail_body"`
+}
+
+// HealthCheckConfig controls active probing of an upstream's targets. Unset
+// fields fall back to backend.health_check_path/interval and built-in defaults.
+type HealthCheckConfig struct {
+	Disabled bool     `json:"disabled"`
+	Path     string   `json:"path"`
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+	// ExpectedStatus lists acceptable status codes; empty accepts 200-399
+	ExpectedStatus []int `json:"expected_status"`
+	// ExpectedBody must appear in the response body when set
+	ExpectedBody       string `json:"expected_body"`
+	HealthyThreshold   int    `json:"healthy_threshold"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold"`
+}
+
+// HealthCheckFor returns the effective health check settings for u. Checks
+// are disabled when no path is configured anywhere.
+func (c *Config) HealthCheckFor(u UpstreamConfig) HealthCheckConfig {
+	hc := HealthCheckConfig{
+		Path:               c.Backend.HealthCheckPath,
+		Interval:           c.Backend.HealthCheckInterval,
+		Timeout:            Duration{5 * time.Second},
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+	if u.HealthCheck != nil {
+		o := u.HealthCheck
+		hc.Disabled = o.Disabled
+		if o.Path != "" {
+			hc.Path = o.Path
+		}
+		if o.Interval.Duration > 0 {
+			hc.Interval = o.Interval
+		}
+		if o.Timeout.Duration > 0 {
+			hc.Timeout = o.Timeout
+		}
+		hc.ExpectedStatus = o.ExpectedStatus
+		hc.ExpectedBody = o.ExpectedBody
+		if o.HealthyThreshold > 0 {
+			hc.HealthyThreshold = o.HealthyThreshold
+		}
+		if o.UnhealthyThreshold > 0 {
+			hc.UnhealthyThreshold = o.UnhealthyThreshold
+		}
+	}
+	if hc.Path == "" || hc.Interval.Duration <= 0 {
+		hc.Disabled = true
+	}
+	return hc
+}
+
+type TargetConfig struct {
+	URL string `json:"url"`
+	// Weight defaults to 1; 0 drains the target, which then gets no traffic
+	Weight *int `json:"weight"`
+}
+
+// TargetWeight returns the target's weight, applying the default
+func (t TargetConfig) TargetWeight() int {
+	if t.Weight == nil {
+		return 1
+	}
+	return *t.Weight
+}
+
+// TargetList returns the upstream's targets, including the URL shorthand
+func (u UpstreamConfig) TargetList() []TargetConfig {
+	targets := u.Targets
+	if u.URL != "" {
+		targets = append([]TargetConfig{{URL: u.URL}}, targets...)
+	}
+	return targets
+}
+
+// RouteConfig matches incoming requests and forwards them to an upstream.
+// Every matcher that is set must match; routes are tried in order.
+type RouteConfig struct {
+	Name string `json:"name"`
+	// Host matches the Host header exactly, or any subdomain with "*.example.com"
+	Host       string   `json:"host"`
+	PathPrefix string   `json:"path_prefix"`
+	PathRegex  string   `json:"path_regex"`
+	Methods    []string `json:"methods"`
+	// Headers must all be present; an empty value only checks presence
+	Headers  map[string]string `json:"headers"`
+	Upstream string            `json:"upstream"`
+	// StripPrefix is removed from the path, then RewritePrefix is prepended
+	StripPrefix   string `json:"strip_prefix"`
+	RewritePrefix string `json:"rewrite_prefix"`
+	// Retry enables retrying failed attempts on another target
+	Retry *RetryConfig `json:"retry"`
+	// CacheKey controls which parts of a request identify its cache entry;
+	// by default the full URL does
+	CacheKey *CacheKeyConfig `json:"cache_key"`
+	// StatusTTL maps status codes such as "404", or classes such as "5xx",
+	// to how long those responses are cached when the backend doesn't say.
+	// Only 200 is cached without a rule; a 0 TTL turns caching off.
+	StatusTTL map[string]Duration `json:"status_ttl"`
+}
+
+// ParseStatusPattern parses a status_ttl key: a status code, or a class such
+// as "5xx", which is returned as its first digit
+func ParseStatusPattern(pattern string) (int, error) {
+	if len(pattern) == 3 && strings.HasSuffix(strings.ToLower(pattern), "xx") {
+		class := int(pattern[0] - '0')
+		if class < 2 || class > 5 {
+			return 0, fmt.Errorf("invalid status class %q", pattern)
+		}
+		return class, nil
+	}
+	code, err := strconv.Atoi(pattern)
+	if err != nil || code < 200 || code > 599 {
+		return 0, fmt.Errorf("invalid status code %q", pattern)
+	}
+	if code == 206 || code == 304 {
+		return 0, fmt.Errorf("status %d can't be cached on its own", code)
+	}
+	return code, nil
+}
+
+// CacheKeyConfig builds a route's cache key from a normalized URL plus
+// selected request headers and cookies. The request sent to the backend is
+// not changed.
+type CacheKeyConfig struct {
+	// QueryInclude keeps only the listed query parameters, QueryExclude
+	// drops them. Names ending in * match by prefix, e.g. "utm_*".
+	QueryInclude []string `json:"query_include"`
+	QueryExclude []string `json:"query_exclude"`
+	// SortQuery orders parameters so their order doesn't matter
+	SortQuery bool `json:"sort_query"`
+	// Lowercase ignores case in the path and query
+	Lowercase bool     `json:"lowercase"`
+	Headers   []string `json:"headers"`
+	Cookies   []string `json:"cookies"`
+	// Identity keys entries by the client's Authorization header (hashed)
+	Identity bool `json:"identity"`
+	// Debug returns the computed key in an X-Cache-Key response header
+	Debug bool `json:"debug"`
+}
+
+// RetryConfig controls retries for one route. Only idempotent methods are
+// retried unless RetryNonIdempotent is set.
+type RetryConfig struct {
+	// MaxAttempts includes the first attempt, default 3
+	MaxAttempts int `json:"max_attempts"`
+	// RetryOnStatus lists response codes worth retrying, default 502, 503, 504.
+	// Connection errors and resets are always retried.
+	RetryOnStatus      []int `json:"retry_on_status"`
+	RetryNonIdempotent bool  `json:"retry_non_idempotent"`
+	// BackoffBase doubles per retry up to BackoffMax, with full jitter
+	BackoffBase Duration `json:"backoff_base"`
+	BackoffMax  Duration `json:"backoff_max"`
+	// MaxBodyBytes is the largest request body buffered for replay, default
+	// 64KB; larger requests are sent once
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+}
+
+// RetryBudgetConfig limits retries to Ratio of requests over Window, plus
+// MinRetriesPerSecond so low-traffic routes can still retry
+type RetryBudgetConfig struct {
+	Ratio               float64  `json:"ratio"`
+	MinRetriesPerSecond float64  `json:"min_retries_per_second"`
+	Window              Duration `json:"window"`
+}
+
+// DefaultUpstream is the upstream name backend.url is registered under
+const DefaultUpstream = "default"
+
+// UpstreamList returns the configured upstreams plus the implicit default one
+func (c *Config) UpstreamList() []UpstreamConfig {
+	list := make([]UpstreamConfig, 0, len(c.Upstreams)+1)
+	hasDefault := false
+	for _, u := range c.Upstreams {
+		if u.Name == DefaultUpstream {
+			hasDefault = true
+		}
+		list = append(list, u)
+	}
+	if !hasDefault && c.Backend.URL != "" {
+		list = append(list, UpstreamConfig{Name: DefaultUpstream, URL: c.Backend.URL})
+	}
+	return list
+}
+
+// RouteList returns the configured routes, or the legacy /proxy/ mount to the
+// default upstream when none are configured
+func (c *Config) RouteList() []RouteConfig {
+	if len(c.Routes) > 0 {
+		return c.Routes
+	}
+	return []RouteConfig{{
+		Name:        DefaultUpstream,
+		PathPrefix:  "/proxy/",
+		Upstream:    DefaultUpstream,
+		StripPrefix: "/proxy",
+	}}
+}
+
+// ReloadConfig controls watching the config file for changes. SIGHUP always
+// triggers a reload regardless of these settings.
+type ReloadConfig struct {
+	Watch    bool     `json:"watch"`
+	Interval Duration `json:"interval"`
+}
+
+// ClientIPConfig controls how the client address used for rate limiting and
+// logging is found when goproxy runs behind load balancers or CDNs
+type ClientIPConfig struct {
+	// TrustedProxies lists the CIDRs (or single addresses) of proxies whose
+	// forwarding headers are believed; headers from other peers are ignored
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Headers are consulted in order: x-forwarded-for, forwarded (RFC 7239)
+	// and x-real-ip by default
+	Headers []string `json:"headers"`
+	// ProxyProtocol expects a PROXY protocol header on every connection from
+	// a trusted proxy, read within ProxyProtocolTimeout
+	ProxyProtocol        bool     `json:"proxy_protocol"`
+	ProxyProtocolTimeout Duration `json:"proxy_protocol_timeout"`
+}
+
+// AdminConfig controls the admin API (cache purging). When Token is set,
+// requests must send it as "Authorization: Bearer <token>".
+type AdminConfig struct {
+	Enabled bool   `json:"enabled"`
+	Token   string `json:"token"`
+}
+
+// Default returns the configuration used when no file, env or flags override it
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:            8080,
+			ReadTimeout:     Duration{30 * time.Second},
+			WriteTimeout:    Duration{30 * time.Second},
+			IdleTimeout:     Duration{60 * time.Second},
+			ShutdownTimeout: Duration{30 * time.Second},
+		},
+		Backend: BackendConfig{
+			URL:                 "http://localhost:8081",
+			HealthCheckPath:     "/health",
+			HealthCheckInterval: Duration{30 * time.Second},
+		},
+		Cache: CacheConfig{
+			TTL:             Duration{5 * time.Minute},
+			MaxBytes:        256 << 20,
+			MaxObjectBytes:  8 << 20,
+			EvictionPolicy:  "lru",
+			CleanupInterval: Duration{time.Minute},
+			StaleRetention:  Duration{10 * time.Minute},
+			CoalesceTimeout: Duration{10 * time.Second},
+			Store:           "memory",
+			Disk: DiskCacheConfig{
+				MaxBytes: 1 << 30,
+			},
+			Warm: WarmConfig{
+				Concurrency:   4,
+				RefreshBefore: Duration{30 * time.Second},
+				CheckInterval: Duration{10 * time.Second},
+			},
+		},
+		RateLimit: RateLimitConfig{
+			RequestsPerMinute: 100,
+			Algorithm:         "token_bucket",
+			Headers:           "separate",
+			ErrorFormat:       "text",
+			CleanupInterval:   Duration{5 * time.Minute},
+			Store: RateLimitStoreConfig{
+				Type:          "memory",
+				Prefix:        "goproxy:ratelimit:",
+				PoolSize:      16,
+				Timeout:       Duration{100 * time.Millisecond},
+				Mode:          "exact",
+				SyncInterval:  Duration{500 * time.Millisecond},
+				RetryInterval: Duration{5 * time.Second},
+			},
+		},
+		Metrics: MetricsConfig{
+			Enabled: true,
+			Path:    "/metrics",
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "text",
+			Output: "stderr",
+		},
+		Reload: ReloadConfig{
+			Interval: Duration{5 * time.Second},
+		},
+		RetryBudget: RetryBudgetConfig{
+			Ratio:               0.2,
+			MinRetriesPerSecond: 3,
+			Window:              Duration{10 * time.Second},
+		},
+		ClientIP: ClientIPConfig{
+			ProxyProtocolTimeout: Duration{5 * time.Second},
+		},
+	}
+}
+
+// Load reads a JSON config file on top of the defaults
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config %s: %w", path, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, describeJSONError(data, err))
+	}
+	return cfg, nil
+}
+
+// describeJSONError adds line and column information to JSON decode errors
+func describeJSONError(data []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+		if typeErr.Field != "" {
+			err = fmt.Errorf("field %q: expected %s, got JSON %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+	default:
+		return err
+	}
+
+	line, col := 1, 1
+	for i := int64(0); i < offset && i < int64(len(data)); i++ {
+		if data[i] == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Errorf("line %d, column %d: %v", line, col, err)
+}
+
+// envVar maps a GOPROXY_* environment variable onto a config field
+type envVar struct {
+	name  string
+	apply func(cfg *Config, value string) error
+}
+
+var envVars = []envVar{
+	{"GOPROXY_PORT", func(c *Config, v string) error { return parseInt(v, &c.Server.Port) }},
+	{"GOPROXY_READ_TIMEOUT", func(c *Config, v string) error { return parseDuration(v, &c.Server.ReadTimeout) }},
+	{"GOPROXY_WRITE_TIMEOUT", func(c *Config, v string) error { return parseDuration(v, &c.Server.WriteTimeout) }},
+	{"GOPROXY_IDLE_TIMEOUT", func(c *Config, v string) error { return parseDuration(v, &c.Server.IdleTimeout) }},
+	{"GOPROXY_DRAIN_DELAY", func(c *Config, v string) error { return parseDuration(v, &c.Server.DrainDelay) }},
+	{"GOPROXY_SHUTDOWN_TIMEOUT", func(c *Config, v string) error { return parseDuration(v, &c.Server.ShutdownTimeout) }},
+	{"GOPROXY_BACKEND_URL", func(c *Config, v string) error { c.Backend.URL = v; return nil }},
+	{"GOPROXY_HEALTH_CHECK_PATH", func(c *Config, v string) error { c.Backend.HealthCheckPath = v; return nil }},
+	{"GOPROXY_HEALTH_CHECK_INTERVAL", func(c *Config, v string) error { return parseDuration(v, &c.Backend.HealthCheckInterval) }},
+	{"GOPROXY_CACHE_TTL", func(c *Config, v string) error { return parseDuration(v, &c.Cache.TTL) }},
+	{"GOPROXY_CACHE_MAX_SIZE", func(c *Config, v string) error { return parseInt(v, &c.Cache.MaxSize) }},
+	{"GOPROXY_CACHE_MAX_BYTES", func(c *Config, v string) error { return parseInt64(v, &c.Cache.MaxBytes) }},
+	{"GOPROXY_CACHE_MAX_OBJECT_BYTES", func(c *Config, v string) error { return parseInt64(v, &c.Cache.MaxObjectBytes) }},
+	{"GOPROXY_CACHE_EVICTION_POLICY", func(c *Config, v string) error { c.Cache.EvictionPolicy = v; return nil }},
+	{"GOPROXY_CACHE_STORE", func(c *Config, v string) error { c.Cache.Store = v; return nil }},
+	{"GOPROXY_CACHE_DISK_PATH", func(c *Config, v string) error { c.Cache.Disk.Path = v; return nil }},
+	{"GOPROXY_CACHE_CLEANUP_INTERVAL", func(c *Config, v string) error { return parseDuration(v, &c.Cache.CleanupInterval) }},
+	{"GOPROXY_CACHE_STALE_RETENTION", func(c *Config, v string) error { return parseDuration(v, &c.Cache.StaleRetention) }},
+	{"GOPROXY_RATE_LIMIT", func(c *Config, v string) error { return parseInt(v, &c.RateLimit.RequestsPerMinute) }},
+	{"GOPROXY_RATE_LIMIT_BURST", func(c *Config, v string) error { return parseInt(v, &c.RateLimit.BurstSize) }},
+	{"GOPROXY_RATE_LIMIT_ALGORITHM", func(c *Config, v string) error { c.RateLimit.Algorithm = v; return nil }},
+	{"GOPROXY_RATE_LIMIT_HEADERS", func(c *Config, v string) error { c.RateLimit.Headers = v; return nil }},
+	{"GOPROXY_RATE_LIMIT_STORE", func(c *Config, v string) error { c.RateLimit.Store.Type = v; return nil }},
+	{"GOPROXY_RATE_LIMIT_STORE_URL", func(c *Config, v string) error { c.RateLimit.Store.URL = v; return nil }},
+	{"GOPROXY_METRICS_ENABLED", func(c *Config, v string) error { return parseBool(v, &c.Metrics.Enabled) }},
+	{"GOPROXY_METRICS_PATH", func(c *Config, v string) error { c.Metrics.Path = v; return nil }},
+	{"GOPROXY_LOG_LEVEL", func(c *Config, v string) error { c.Logging.Level = v; return nil }},
+	{"GOPROXY_LOG_FORMAT", func(c *Config, v string) error { c.Logging.Format = v; return nil }},
+	{"GOPROXY_LOG_OUTPUT", func(c *Config, v string) error { c.Logging.Output = v; return nil }},
+	{"GOPROXY_RELOAD_WATCH", func(c *Config, v string) error { return parseBool(v, &c.Reload.Watch) }},
+	{"GOPROXY_ADMIN_ENABLED", func(c *Config, v string) error { return parseBool(v, &c.Admin.Enabled) }},
+	{"GOPROXY_ADMIN_TOKEN", func(c *Config, v string) error { c.Admin.Token = v; return nil }},
+	{"GOPROXY_TRUSTED_PROXIES", func(c *Config, v string) error { c.ClientIP.TrustedProxies = splitList(v); return nil }},
+	{"GOPROXY_PROXY_PROTOCOL", func(c *Config, v string) error { return parseBool(v, &c.ClientIP.ProxyProtocol) }},
+}
+
+// ApplyEnv overrides config fields from GOPROXY_* environment variables
+func (c *Config) ApplyEnv() error {
+	var errs []error
+	for _, ev := range envVars {
+		value, ok := os.LookupEnv(ev.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := ev.apply(c, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", ev.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func parseInt(value string, dst *int) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", value)
+	}
+	*dst = n
+	return nil
+}
+
+func parseInt64(value string, dst *int64) error {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", value)
+	}
+	*dst = n
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseBool(value string, dst *bool) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", value)
+	}
+	*dst = b
+	return nil
+}
+
+func parseDuration(value string, dst *Duration) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+	dst.Duration = d
+	return nil
+}
+
+// Validate checks the config and reports every problem it finds
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		fail("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if c.Server.ReadTimeout.Duration < 0 {
+		fail("server.read_timeout", "must not be negative")
+	}
+	if c.Server.WriteTimeout.Duration < 0 {
+		fail("server.write_timeout", "must not be negative")
+	}
+	if c.Server.IdleTimeout.Duration < 0 {
+		fail("server.idle_timeout", "must not be negative")
+	}
+	if c.Server.DrainDelay.Duration < 0 {
+		fail("server.drain_delay", "must not be negative")
+	}
+	if c.Server.ShutdownTimeout.Duration <= 0 {
+		fail("server.shutdown_timeout", "must be positive")
+	}
+
+	validateURL("backend.url", c.Backend.URL, fail)
+	if c.Backend.HealthCheckPath != "" && !strings.HasPrefix(c.Backend.HealthCheckPath, "/") {
+		fail("backend.health_check_path", "must start with /, got %q", c.Backend.HealthCheckPath)
+	}
+	if c.Backend.HealthCheckInterval.Duration < 0 {
+		fail("backend.health_check_interval", "must not be negative")
+	}
+
+	if c.Cache.TTL.Duration <= 0 {
+		fail("cache.ttl", "must be positive")
+	}
+	if c.Cache.MaxSize < 0 {
+		fail("cache.max_size", "must not be negative (0 means unlimited)")
+	}
+	if c.Cache.MaxBytes < 0 {
+		fail("cache.max_bytes", "must not be negative (0 means unlimited)")
+	}
+	if c.Cache.MaxObjectBytes < 0 {
+		fail("cache.max_object_bytes", "must not be negative (0 means unlimited)")
+	}
+	switch c.Cache.EvictionPolicy {
+	case "", "lru", "lfu", "tinylfu":
+	default:
+		fail("cache.eviction_policy", "must be one of lru, lfu, tinylfu; got %q", c.Cache.EvictionPolicy)
+	}
+	switch c.Cache.Store {
+	case "", "memory":
+	case "disk", "tiered":
+		if c.Cache.Disk.Path == "" {
+			fail("cache.disk.path", "is required for the %s store", c.Cache.Store)
+		}
+	default:
+		fail("cache.store", "must be one of memory, disk, tiered; got %q", c.Cache.Store)
+	}
+	if c.Cache.Warm.Concurrency <= 0 {
+		fail("cache.warm.concurrency", "must be positive")
+	}
+	if c.Cache.Warm.RefreshBefore.Duration < 0 {
+		fail("cache.warm.refresh_before", "must not be negative")
+	}
+	if len(c.Cache.Warm.Hot) > 0 && c.Cache.Warm.CheckInterval.Duration <= 0 {
+		fail("cache.warm.check_interval", "must be positive when cache.warm.hot is set")
+	}
+	if c.Cache.Warm.Prefix != "" && !strings.HasPrefix(c.Cache.Warm.Prefix, "/") {
+		fail("cache.warm.prefix", "must start with /, got %q", c.Cache.Warm.Prefix)
+	}
+	if c.Cache.Disk.MaxSize < 0 {
+		fail("cache.disk.max_size", "must not be negative (0 means unlimited)")
+	}
+	if c.Cache.Disk.MaxBytes < 0 {
+		fail("cache.disk.max_bytes", "must not be negative (0 means unlimited)")
+	}
+	if c.Cache.CleanupInterval.Duration <= 0 {
+		fail("cache.cleanup_interval", "must be positive")
+	}
+	if c.Cache.StaleRetention.Duration < 0 {
+		fail("cache.stale_retention", "must not be negative")
+	}
+	if c.Cache.StaleWhileRevalidate.Duration < 0 {
+		fail("cache.stale_while_revalidate", "must not be negative")
+	}
+	if c.Cache.StaleIfError.Duration < 0 {
+		fail("cache.stale_if_error", "must not be negative")
+	}
+	if c.Cache.CoalesceTimeout.Duration < 0 {
+		fail("cache.coalesce_timeout", "must not be negative (0 disables coalescing)")
+	}
+	validateStatusTTL("cache.status_ttl", c.Cache.StatusTTL, fail)
+
+	if c.RateLimit.RequestsPerMinute < 1 {
+		fail("rate_limit.requests_per_minute", "must be at least 1, got %d", c.RateLimit.RequestsPerMinute)
+	}
+	if c.RateLimit.BurstSize < 0 {
+		fail("rate_limit.burst_size", "must not be negative")
+	}
+	switch c.RateLimit.Algorithm {
+	case "", "token_bucket", "gcra", "sliding_window":
+	default:
+		fail("rate_limit.algorithm", "must be one of token_bucket, gcra, sliding_window; got %q", c.RateLimit.Algorithm)
+	}
+	if c.RateLimit.CleanupInterval.Duration <= 0 {
+		fail("rate_limit.cleanup_interval", "must be positive")
+	}
+	switch c.RateLimit.Headers {
+	case "", "separate", "combined", "none":
+	default:
+		fail("rate_limit.headers", "must be one of separate, combined, none; got %q", c.RateLimit.Headers)
+	}
+	switch c.RateLimit.ErrorFormat {
+	case "", "text", "json", "html":
+	default:
+		fail("rate_limit.error_format", "must be one of text, json, html; got %q", c.RateLimit.ErrorFormat)
+	}
+	switch store := c.RateLimit.Store; store.Type {
+	case "", "memory":
+	case "redis":
+		if u, err := url.Parse(store.URL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			fail("rate_limit.store.url", "must be redis://host:port or rediss://host:port, got %q", store.URL)
+		}
+		if store.PoolSize < 1 {
+			fail("rate_limit.store.pool_size", "must be at least 1, got %d", store.PoolSize)
+		}
+		if store.Timeout.Duration <= 0 {
+			fail("rate_limit.store.timeout", "must be positive")
+		}
+		switch store.Mode {
+		case "", "exact":
+		case "approximate":
+			if store.SyncInterval.Duration <= 0 {
+				fail("rate_limit.store.sync_interval", "must be positive in approximate mode")
+			}
+			// Batched counts only make sense for counters; token_bucket and
+			// gcra state can't be summed across instances
+			if len(c.RateLimit.Policies) == 0 && c.RateLimit.Algorithm != "sliding_window" {
+				fail("rate_limit.algorithm", "must be sliding_window in approximate store mode, got %q", c.RateLimit.Algorithm)
+			}
+			for i, p := range c.RateLimit.Policies {
+				algorithm := p.Algorithm
+				if algorithm == "" {
+					algorithm = c.RateLimit.Algorithm
+				}
+				if algorithm != "sliding_window" {
+					fail(fmt.Sprintf("rate_limit.policies[%d].algorithm", i), "must be sliding_window in approximate store mode, got %q", algorithm)
+				}
+			}
+		default:
+			fail("rate_limit.store.mode", "must be exact or approximate, got %q", store.Mode)
+		}
+		if store.RetryInterval.Duration <= 0 {
+			fail("rate_limit.store.retry_interval", "must be positive")
+		}
+	default:
+		fail("rate_limit.store.type", "must be memory or redis, got %q", store.Type)
+	}
+
+	if c.Metrics.Enabled && !strings.HasPrefix(c.Metrics.Path, "/") {
+		fail("metrics.path", "must start with /, got %q", c.Metrics.Path)
+	}
+	if c.Metrics.RetentionPeriod.Duration < 0 {
+		fail("metrics.retention_period", "must not be negative")
+	}
+
+	switch strings.ToLower(c.Logging.Level) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		fail("logging.level", "must be one of debug, info, warn, error; got %q", c.Logging.Level)
+	}
+	switch strings.ToLower(c.Logging.Format) {
+	case "text", "json":
+	default:
+		fail("logging.format", "must be text or json, got %q", c.Logging.Format)
+	}
+	if c.Logging.Output == "" {
+		fail("logging.output", "must be stdout, stderr or a file path")
+	}
+
+	upstreams := make(map[string]bool)
+	for i, u := range c.Upstreams {
+		field := fmt.Sprintf("upstreams[%d]", i)
+		if u.Name == "" {
+			fail(field+".name", "is required")
+		} else if upstreams[u.Name] {
+			fail(field+".name", "duplicate upstream %q", u.Name)
+		}
+		upstreams[u.Name] = true
+		if len(u.TargetList()) == 0 {
+			fail(field, "needs url or at least one entry in targets")
+		}
+		if u.URL != "" {
+			validateURL(field+".url", u.URL, fail)
+		}
+		for j, t := range u.Targets {
+			validateURL(fmt.Sprintf("%s.targets[%d].url", field, j), t.URL, fail)
+			if t.TargetWeight() < 0 {
+				fail(fmt.Sprintf("%s.targets[%d].weight", field, j), "must not be negative")
+			}
+		}
+		if targets := u.TargetList(); len(targets) > 0 {
+			weighted := false
+			for _, t := range targets {
+				weighted = weighted || t.TargetWeight() > 0
+			}
+			if !weighted {
+				fail(field+".targets", "at least one target needs a weight above 0")
+			}
+		}
+		switch u.LoadBalancer {
+		case "", "round_robin", "weighted_round_robin", "least_connections", "random_two_choices", "consistent_hash":
+		default:
+			fail(field+".load_balancer", "must be one of round_robin, weighted_round_robin, least_connections, random_two_choices, consistent_hash; got %q", u.LoadBalancer)
+		}
+		if u.HashKey != "" && u.HashKey != "client_ip" && !strings.HasPrefix(u.HashKey, "header:") {
+			fail(field+".hash_key", "must be client_ip or header:<Name>, got %q", u.HashKey)
+		}
+		if cb := u.CircuitBreaker; cb != nil {
+			if cb.ConsecutiveFailures < 0 || cb.HalfOpenRequests < 0 {
+				fail(field+".circuit_breaker", "counts must not be negative")
+			}
+			if cb.LatencyThreshold.Duration < 0 || cb.OpenDuration.Duration < 0 {
+				fail(field+".circuit_breaker", "durations must not be negative")
+			}
+			if cb.FailStatus != 0 && (cb.FailStatus < 400 || cb.FailStatus > 599) {
+				fail(field+".circuit_breaker.fail_status", "must be a 4xx or 5xx status, got %d", cb.FailStatus)
+			}
+		}
+		if hc := u.HealthCheck; hc != nil {
+			if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+				fail(field+".health_check.path", "must start with /, got %q", hc.Path)
+			}
+			if hc.Interval.Duration < 0 || hc.Timeout.Duration < 0 {
+				fail(field+".health_check", "interval and timeout must not be negative")
+			}
+			if hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+				fail(field+".health_check", "thresholds must not be negative")
+			}
+			for _, code := range hc.ExpectedStatus {
+				if code < 100 || code > 599 {
+					fail(field+".health_check.expected_status", "invalid status code %d", code)
+				}
+			}
+		}
+	}
+	upstreams[DefaultUpstream] = true
+
+	routes := make(map[string]bool)
+	for i, r := range c.Routes {
+		field := fmt.Sprintf("routes[%d]", i)
+		if r.Name == "" {
+			fail(field+".name", "is required")
+		} else if routes[r.Name] {
+			fail(field+".name", "duplicate route %q", r.Name)
+		}
+		routes[r.Name] = true
+		if r.Upstream == "" {
+			fail(field+".upstream", "is required")
+		} else if !upstreams[r.Upstream] {
+			fail(field+".upstream", "unknown upstream %q", r.Upstream)
+		}
+		if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+			fail(field+".path_prefix", "must start with /, got %q", r.PathPrefix)
+		}
+		if r.PathRegex != "" {
+			if _, err := regexp.Compile(r.PathRegex); err != nil {
+				fail(field+".path_regex", "%v", err)
+			}
+		}
+		if r.RewritePrefix != "" && !strings.HasPrefix(r.RewritePrefix, "/") {
+			fail(field+".rewrite_prefix", "must start with /, got %q", r.RewritePrefix)
+		}
+		if rc := r.Retry; rc != nil {
+			if rc.MaxAttempts < 0 {
+				fail(field+".retry.max_attempts", "must not be negative")
+			}
+			if rc.BackoffBase.Duration < 0 || rc.BackoffMax.Duration < 0 {
+				fail(field+".retry", "backoff durations must not be negative")
+			}
+			if rc.MaxBodyBytes < 0 {
+				fail(field+".retry.max_body_bytes", "must not be negative")
+			}
+			for _, code := range rc.RetryOnStatus {
+				if code < 100 || code > 599 {
+					fail(field+".retry.retry_on_status", "invalid status code %d", code)
+				}
+			}
+		}
+		validateStatusTTL(field+".status_ttl", r.StatusTTL, fail)
+		if ck := r.CacheKey; ck != nil {
+			if len(ck.QueryInclude) > 0 && len(ck.QueryExclude) > 0 {
+				fail(field+".cache_key", "query_include and query_exclude can't both be set")
+			}
+			for _, name := range append(append([]string{}, ck.Headers...), ck.Cookies...) {
+				if strings.TrimSpace(name) == "" {
+					fail(field+".cache_key", "header and cookie names must not be empty")
+				}
+			}
+		}
+	}
+
+	routeNames := make(map[string]bool)
+	for _, r := range c.RouteList() {
+		routeNames[r.Name] = true
+	}
+	policies := make(map[string]bool)
+	for i, p := range c.RateLimit.Policies {
+		field := fmt.Sprintf("rate_limit.policies[%d]", i)
+		if p.Name == "" {
+			fail(field+".name", "is required")
+		} else if policies[p.Name] {
+			fail(field+".name", "duplicate policy %q", p.Name)
+		}
+		policies[p.Name] = true
+		if len(p.Key) == 0 {
+			fail(field+".key", "is required")
+		}
+		for _, part := range p.Key {
+			kind, name, _ := strings.Cut(strings.TrimSpace(part), ":")
+			switch strings.ToLower(kind) {
+			case "ip", "route":
+				if name == "" {
+					continue
+				}
+			case "header", "query", "cookie", "jwt":
+				if name != "" {
+					continue
+				}
+			}
+			fail(field+".key", "must be ip, route, header:<Name>, query:<name>, cookie:<name> or jwt:<claim>; got %q", part)
+		}
+		for _, route := range p.Routes {
+			if !routeNames[route] {
+				fail(field+".routes", "unknown route %q", route)
+			}
+		}
+		if p.Limit < 1 {
+			fail(field+".limit", "must be at least 1, got %d", p.Limit)
+		}
+		if p.Window.Duration < 0 {
+			fail(field+".window", "must not be negative")
+		}
+		if p.Burst < 0 {
+			fail(field+".burst", "must not be negative")
+		}
+		switch p.Algorithm {
+		case "", "token_bucket", "gcra", "sliding_window":
+		default:
+			fail(field+".algorithm", "must be one of token_bucket, gcra, sliding_window; got %q", p.Algorithm)
+		}
+	}
+
+	if c.RetryBudget.Ratio < 0 {
+		fail("retry_budget.ratio", "must not be negative")
+	}
+	if c.RetryBudget.MinRetriesPerSecond < 0 {
+		fail("retry_budget.min_retries_per_second", "must not be negative")
+	}
+	if c.RetryBudget.Window.Duration < time.Second {
+		fail("retry_budget.window", "must be at least 1s")
+	}
+
+	for _, proxy := range c.ClientIP.TrustedProxies {
+		var err error
+		if strings.Contains(proxy, "/") {
+			_, err = netip.ParsePrefix(proxy)
+		} else {
+			_, err = netip.ParseAddr(proxy)
+		}
+		if err != nil {
+			fail("client_ip.trusted_proxies", "invalid address or CIDR %q", proxy)
+		}
+	}
+	for _, header := range c.ClientIP.Headers {
+		switch strings.ToLower(header) {
+		case "x-forwarded-for", "forwarded", "x-real-ip":
+		default:
+			fail("client_ip.headers", "must be x-forwarded-for, forwarded or x-real-ip; got %q", header)
+		}
+	}
+	if c.ClientIP.ProxyProtocol && len(c.ClientIP.TrustedProxies) == 0 {
+		fail("client_ip.proxy_protocol", "requires trusted_proxies, the load balancers sending the header")
+	}
+	if c.ClientIP.ProxyProtocolTimeout.Duration < 0 {
+		fail("client_ip.proxy_protocol_timeout", "must not be negative")
+	}
+
+	if c.Reload.Watch && c.Reload.Interval.Duration <= 0 {
+		fail("reload.interval", "must be positive when reload.watch is enabled")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %w", joinIndented(errs))
+	}
+	return nil
+}
+
+func validateURL(field, raw string, fail func(field, format string, args ...interface{})) {
+	if raw == "" {
+		fail(field, "is required")
+	} else if u, err := url.Parse(raw); err != nil {
+		fail(field, "invalid URL: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		fail(field, "scheme must be http or https, got %q", u.Scheme)
+	} else if u.Host == "" {
+		fail(field, "missing host in %q", raw)
+	}
+}
+
+// validateStatusTTL checks the patterns and TTLs of a status_ttl map
+func validateStatusTTL(field string, rules map[string]Duration, fail func(field, format string, args ...interface{})) {
+	patterns := make([]string, 0, len(rules))
+	for pattern := range rules {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		ttl := rules[pattern]
+		if _, err := ParseStatusPattern(pattern); err != nil {
+			fail(field, "%v", err)
+		}
+		if ttl.Duration < 0 {
+			fail(field, "%s: must not be negative (0 disables caching)", pattern)
+		}
+	}
+}
+
+// joinIndented joins errors one per line so they line up under the header
+func joinIndented(errs []error) error {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return errors.New(strings.Join(msgs, "\n  "))
+}
+
+// RestartRequired lists settings that differ between c and next but only take
+// effect on restart, so a reload can warn about them
+func (c *Config) RestartRequired(next *Config) []string {
+	var fields []string
+	if c.Server != next.Server {
+		fields = append(fields, "server")
+	}
+	if c.Cache.MaxSize != next.Cache.MaxSize || c.Cache.MaxBytes != next.Cache.MaxBytes ||
+		c.Cache.MaxObjectBytes != next.Cache.MaxObjectBytes || c.Cache.EvictionPolicy != next.Cache.EvictionPolicy ||
+		c.Cache.CleanupInterval != next.Cache.CleanupInterval {
+		fields = append(fields, "cache limits/eviction_policy/cleanup_interval")
+	}
+	if c.Cache.Store != next.Cache.Store || c.Cache.Disk != next.Cache.Disk {
+		fields = append(fields, "cache.store/disk")
+	}
+	if c.RateLimit.CleanupInterval != next.RateLimit.CleanupInterval {
+		fields = append(fields, "rate_limit.cleanup_interval")
+	}
+	if c.RateLimit.Store != next.RateLimit.Store {
+		fields = append(fields, "rate_limit.store")
+	}
+	if c.Metrics != next.Metrics {
+		fields = append(fields, "metrics")
+	}
+	if c.Logging != next.Logging {
+		fields = append(fields, "logging")
+	}
+	if c.Reload != next.Reload {
+		fields = append(fields, "reload")
+	}
+	if c.Admin != next.Admin {
+		fields = append(fields, "admin")
+	}
+	if c.ClientIP.ProxyProtocol != next.ClientIP.ProxyProtocol || c.ClientIP.ProxyProtocolTimeout != next.ClientIP.ProxyProtocolTimeout {
+		fields = append(fields, "client_ip.proxy_protocol")
+	}
+	return fields
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"os"
+	"time"
+)
+
+// Watch polls path every interval and calls onChange whenever its size or
+// modification time changes. It returns when stop is closed.
+func Watch(path string, interval time.Duration, stop <-chan struct{}, onChange func()) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastMod time.Time
+	var lastSize int64 = -1
+	if info, err := os.Stat(path); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				// File may be mid-replace by an editor; try again next tick
+				continue
+			}
+			if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+				continue
+			}
+			lastMod, lastSize = info.ModTime(), info.Size()
+			onChange()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -1,3 +1,7 @@
 module goproxy
 
 go 1.21
+
+require github.com/alicebob/miniredis/v2 v2.39.0
+
+require github.com/yuin/gopher-lua v1.1.1 // indirect
@@ -1,122 +1,497 @@
 package main
 
 import (
-    "embed"
-    "flag"
-    "io/fs"
-    "log"
-    "net/http"
-    "os"
-    "os/signal"
-    "syscall"
-    "time"
-
-    "goproxy/cache"
-    "goproxy/metrics"
-    "goproxy/proxy"
-    "goproxy/ratelimit"
-)
+	"context"
+	"crypto/subtle"
+	"embed"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-type Config struct {
-	Port            string
-	BackendURL      string
-	RateLimitPerMin int
-	CacheTTL        time.Duration
-}
+	"goproxy/cache"
+	"goproxy/clientip"
+	"goproxy/config"
+	"goproxy/metrics"
+	"goproxy/proxy"
+	"goproxy/ratelimit"
+	"goproxy/warm"
+)
 
 //go:embed ui/*
 var embeddedUI embed.FS
 
 func main() {
-	config := parseFlags()
-	
+	loader := parseFlags()
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	if err := setupLogging(cfg.Logging); err != nil {
+		log.Fatalf("Logging setup error: %v", err)
+	}
+
 	// Initialize components
-	cacheManager := cache.New(config.CacheTTL)
-	rateLimiter := ratelimit.New(config.RateLimitPerMin)
-	metricsCollector := metrics.New()
-	
-    // Create reverse proxy
-    reverseProxy := proxy.New(config.BackendURL, cacheManager, rateLimiter, metricsCollector)
-	
+	cacheStore, err := newCacheStore(cfg.Cache)
+	if err != nil {
+		log.Fatalf("Cache setup error: %v", err)
+	}
+	cacheManager := cache.New(cfg.Cache.TTL.Duration, cacheStore, cfg.Cache.CleanupInterval.Duration)
+	cacheManager.SetStaleRetention(cfg.Cache.Retention())
+	rateLimitShared, err := newRateLimitShared(cfg.RateLimit.Store)
+	if err != nil {
+		log.Fatalf("Rate limiter setup error: %v", err)
+	}
+	rateLimiter, err := ratelimit.New(rateLimitPolicies(cfg.RateLimit), cfg.RateLimit.CleanupInterval.Duration, rateLimitShared)
+	if err != nil {
+		log.Fatalf("Rate limiter setup error: %v", err)
+	}
+	metricsCollector := metrics.New(cfg.Metrics.RetentionPeriod.Duration)
+	metricsCollector.SetCacheStatsFunc(func() []metrics.CacheStats {
+		var stats []metrics.CacheStats
+		for _, s := range cacheManager.Stats() {
+			stats = append(stats, metrics.CacheStats{Tier: s.Tier, Entries: s.Entries, Bytes: s.Bytes,
+				Evictions: s.Evictions, Expired: s.Expired, Rejected: s.Rejected, Promotions: s.Promotions})
+		}
+		return stats
+	})
+
+	// Create reverse proxy
+	reverseProxy, err := proxy.New(cfg, cacheManager, rateLimiter, metricsCollector)
+	if err != nil {
+		log.Fatalf("Proxy setup error: %v", err)
+	}
+
+	warmer := warm.New(cfg.Cache.Warm, reverseProxy, metricsCollector)
+
+	reloader := &configReloader{
+		loader:       loader,
+		current:      cfg,
+		version:      1,
+		cacheManager: cacheManager,
+		rateLimiter:  rateLimiter,
+		proxy:        reverseProxy,
+		metrics:      metricsCollector,
+		warmer:       warmer,
+	}
+	metricsCollector.SetConfigVersion(reloader.version)
+
 	// Setup HTTP server
 	mux := http.NewServeMux()
-	
-    // UI assets (served from embedded filesystem)
-    uiSub, err := fs.Sub(embeddedUI, "ui")
-    if err != nil {
-        log.Printf("warning: UI assets not available: %v", err)
-    }
-
-    // Favicon (avoid proxying this and spamming logs)
-    mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-        w.WriteHeader(http.StatusNoContent)
-    })
-
-    // Routes
-    // Make UI the landing page at root
-    if err == nil {
-        mux.Handle("/", http.FileServer(http.FS(uiSub)))
-    }
-    // Expose reverse proxy under /proxy/ (strip the prefix when forwarding)
-    mux.Handle("/proxy/", http.StripPrefix("/proxy", http.HandlerFunc(reverseProxy.HandleRequest)))
-	
+
+	// UI assets (served from embedded filesystem)
+	uiSub, err := fs.Sub(embeddedUI, "ui")
+	if err != nil {
+		log.Printf("warning: UI assets not available: %v", err)
+	}
+
+	// Favicon (avoid proxying this and spamming logs)
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Routes
+	// Requests matching the route table are proxied; anything else falls
+	// through to the UI, which is the landing page at root
+	var uiHandler http.Handler
+	if err == nil {
+		uiHandler = http.FileServer(http.FS(uiSub))
+	}
+	mux.Handle("/", reverseProxy.Handler(uiHandler))
+
 	// Metrics endpoint
-	mux.HandleFunc("/metrics", metricsCollector.HandleMetrics)
-    mux.HandleFunc("/metrics.json", metricsCollector.HandleJSONMetrics)
-    mux.HandleFunc("/requests.json", metricsCollector.HandleRecentRequests)
-	
-	// Health check endpoint
+	if cfg.Metrics.Enabled {
+		mux.HandleFunc(cfg.Metrics.Path, metricsCollector.HandleMetrics)
+		mux.HandleFunc("/metrics.json", metricsCollector.HandleJSONMetrics)
+		mux.HandleFunc("/requests.json", metricsCollector.HandleRecentRequests)
+		mux.HandleFunc("/upstreams.json", metricsCollector.HandleUpstreams)
+	}
+
+	// Admin API
+	if cfg.Admin.Enabled {
+		if cfg.Admin.Token == "" {
+			log.Printf("warning: admin API enabled without admin.token; anyone who can reach it can purge the cache")
+		}
+		mux.Handle("/admin/cache/purge", requireToken(cfg.Admin.Token, http.HandlerFunc(reverseProxy.HandlePurge)))
+		mux.Handle("/admin/cache/warm", requireToken(cfg.Admin.Token, http.HandlerFunc(warmer.HandleWarm)))
+	}
+
+	// Health check endpoint (reports draining during shutdown so load
+	// balancers take this instance out of rotation)
+	var draining atomic.Bool
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("DRAINING"))
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
-	
+
+	port := strconv.Itoa(cfg.Server.Port)
 	server := &http.Server{
-		Addr:         ":" + config.Port,
+		Addr:         ":" + port,
 		Handler:      mux,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  cfg.Server.ReadTimeout.Duration,
+		WriteTimeout: cfg.Server.WriteTimeout.Duration,
+		IdleTimeout:  cfg.Server.IdleTimeout.Duration,
 	}
-	
+
 	// Start server in a goroutine
 	go func() {
-		log.Printf("Starting goproxy server on port %s", config.Port)
-		log.Printf("Backend URL: %s", config.BackendURL)
-		log.Printf("Rate limit: %d requests/min", config.RateLimitPerMin)
-		log.Printf("Cache TTL: %v", config.CacheTTL)
-		
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Starting goproxy server on port %s", port)
+		log.Printf("Backend URL: %s", cfg.Backend.URL)
+		for _, rc := range cfg.RouteList() {
+			log.Printf("Route %s: host=%q prefix=%q regex=%q -> upstream %s", rc.Name, rc.Host, rc.PathPrefix, rc.PathRegex, rc.Upstream)
+		}
+		for _, p := range rateLimitPolicies(cfg.RateLimit) {
+			log.Printf("Rate limit %s: %d per %v per %s, burst %d (%s)", p.Name, p.Rate.Limit, p.Rate.Window,
+				strings.Join(p.Key, "+"), p.Rate.Burst, p.Algorithm)
+		}
+		if store := cfg.RateLimit.Store; store.Type == "redis" {
+			if u, err := url.Parse(store.URL); err == nil {
+				log.Printf("Rate limit store: %s (%s)", u.Redacted(), store.Mode)
+			}
+		}
+		log.Printf("Cache TTL: %v", cfg.Cache.TTL.Duration)
+
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			log.Fatalf("Server error: %v", err)
+		}
+		if cfg.ClientIP.ProxyProtocol {
+			log.Printf("Expecting PROXY protocol headers from %s", strings.Join(cfg.ClientIP.TrustedProxies, ", "))
+			listener = &clientip.Listener{Listener: listener, Trusted: reverseProxy.TrustedProxy, Timeout: cfg.ClientIP.ProxyProtocolTimeout.Duration}
+		}
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
-	
+
+	// Warm up alongside serving; requests for URLs not yet warmed simply miss
+	warmer.Start()
+
+	// Reload on SIGHUP and, if enabled, when the config file changes
+	stopWatch := make(chan struct{})
+	if loader.path != "" && cfg.Reload.Watch {
+		go config.Watch(loader.path, cfg.Reload.Interval.Duration, stopWatch, func() {
+			reloader.Reload("file change")
+		})
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloader.Reload("SIGHUP")
+		}
+	}()
+
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	
+	close(stopWatch)
+
 	log.Println("Shutting down server...")
-	
+
+	// Drain phase: fail health checks while still serving, so the outer load
+	// balancer stops routing here before the listener goes away. A second
+	// signal skips the wait.
+	draining.Store(true)
+	metricsCollector.SetDraining(true)
+	server.SetKeepAlivesEnabled(false)
+	if delay := cfg.Server.DrainDelay.Duration; delay > 0 {
+		log.Printf("Draining: reporting unhealthy for %v (%d requests in flight)", delay, metricsCollector.InFlightRequests())
+		select {
+		case <-time.After(delay):
+		case <-quit:
+		}
+	}
+
+	// Stop accepting connections and wait for in-flight requests
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration)
+	defer cancel()
+	log.Printf("Waiting up to %v for %d in-flight requests", cfg.Server.ShutdownTimeout.Duration, metricsCollector.InFlightRequests())
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown deadline reached, force-closing %d in-flight requests: %v", metricsCollector.InFlightRequests(), err)
+		server.Close()
+	}
+
 	// Cleanup
-	cacheManager.Close()
+	warmer.Close()
+	reverseProxy.Close()
+	if err := cacheManager.Close(); err != nil {
+		log.Printf("Cache close error: %v", err)
+	}
 	rateLimiter.Close()
-	
+
 	log.Println("Server stopped")
 }
 
-func parseFlags() *Config {
+// requireToken rejects requests without "Authorization: Bearer <token>",
+// unless token is empty
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitPolicies converts the rate limit settings for the limiter. Without
+// configured policies, requests_per_minute applies per client IP.
+func rateLimitPolicies(cfg config.RateLimitConfig) []ratelimit.PolicySpec {
+	if len(cfg.Policies) == 0 {
+		return []ratelimit.PolicySpec{{
+			Name:      ratelimit.DefaultPolicy,
+			Key:       []string{"ip"},
+			Algorithm: cfg.Algorithm,
+			Rate:      ratelimit.PerMinute(cfg.RequestsPerMinute, cfg.BurstSize),
+		}}
+	}
+	specs := make([]ratelimit.PolicySpec, 0, len(cfg.Policies))
+	for _, p := range cfg.Policies {
+		spec := ratelimit.PolicySpec{
+			Name:      p.Name,
+			Key:       p.Key,
+			Routes:    p.Routes,
+			Algorithm: p.Algorithm,
+			Rate:      ratelimit.Rate{Limit: p.Limit, Window: p.Window.Duration, Burst: p.Burst},
+		}
+		if spec.Algorithm == "" {
+			spec.Algorithm = cfg.Algorithm
+		}
+		if spec.Rate.Window <= 0 {
+			spec.Rate.Window = time.Minute
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// newRateLimitShared builds the store rate limit counts are shared through,
+// or returns nil to count in this instance only
+func newRateLimitShared(cfg config.RateLimitStoreConfig) (*ratelimit.Shared, error) {
+	if cfg.Type != "redis" {
+		return nil, nil
+	}
+	store, err := ratelimit.NewRedisStore(cfg.URL, cfg.Prefix, cfg.PoolSize)
+	if err != nil {
+		return nil, err
+	}
+	return &ratelimit.Shared{
+		Store:         store,
+		Timeout:       cfg.Timeout.Duration,
+		Approximate:   cfg.Mode == "approximate",
+		SyncInterval:  cfg.SyncInterval.Duration,
+		RetryInterval: cfg.RetryInterval.Duration,
+	}, nil
+}
+
+// newCacheStore builds the configured cache storage backend
+func newCacheStore(cfg config.CacheConfig) (cache.Store, error) {
+	memLimits := cache.Limits{
+		MaxEntries:     cfg.MaxSize,
+		MaxBytes:       cfg.MaxBytes,
+		MaxObjectBytes: cfg.MaxObjectBytes,
+		Policy:         cfg.EvictionPolicy,
+	}
+	diskLimits := cache.Limits{
+		MaxEntries:     cfg.Disk.MaxSize,
+		MaxBytes:       cfg.Disk.MaxBytes,
+		MaxObjectBytes: cfg.MaxObjectBytes,
+		Policy:         cfg.EvictionPolicy,
+	}
+	switch cfg.Store {
+	case "disk":
+		return cache.NewDiskStore(cfg.Disk.Path, diskLimits)
+	case "tiered":
+		memory, err := cache.NewMemoryStore(memLimits)
+		if err != nil {
+			return nil, err
+		}
+		disk, err := cache.NewDiskStore(cfg.Disk.Path, diskLimits)
+		if err != nil {
+			return nil, err
+		}
+		return cache.NewTieredStore(memory, disk), nil
+	default:
+		return cache.NewMemoryStore(memLimits)
+	}
+}
+
+// configLoader rebuilds the effective config from its sources. Precedence,
+// lowest to highest: built-in defaults, the -config file, GOPROXY_* environment
+// variables, flags given on the command line.
+type configLoader struct {
+	path      string
+	overrides []func(cfg *config.Config) error
+}
+
+func parseFlags() *configLoader {
+	configPath := flag.String("config", os.Getenv("GOPROXY_CONFIG"), "Path to JSON config file (see example_config.json)")
 	port := flag.String("port", "8080", "Port to listen on")
 	backendURL := flag.String("backend", "http://localhost:8081", "Backend URL to proxy to")
 	rateLimitPerMin := flag.Int("rate-limit", 100, "Rate limit per IP per minute")
 	cacheTTL := flag.Duration("cache-ttl", 5*time.Minute, "Cache TTL for GET responses")
-	
+
 	flag.Parse()
-	
-	return &Config{
-		Port:            *port,
-		BackendURL:      *backendURL,
-		RateLimitPerMin: *rateLimitPerMin,
-        CacheTTL:        *cacheTTL,
-	}
-} 
\ No newline at end of file
+
+	loader := &configLoader{path: *configPath}
+
+	// Only flags given explicitly on the command line override file and env
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			loader.override(func(cfg *config.Config) error {
+				p, err := strconv.Atoi(*port)
+				if err != nil {
+					return fmt.Errorf("-port: invalid port %q", *port)
+				}
+				cfg.Server.Port = p
+				return nil
+			})
+		case "backend":
+			loader.override(func(cfg *config.Config) error { cfg.Backend.URL = *backendURL; return nil })
+		case "rate-limit":
+			loader.override(func(cfg *config.Config) error { cfg.RateLimit.RequestsPerMinute = *rateLimitPerMin; return nil })
+		case "cache-ttl":
+			loader.override(func(cfg *config.Config) error { cfg.Cache.TTL.Duration = *cacheTTL; return nil })
+		}
+	})
+	return loader
+}
+
+func (l *configLoader) override(fn func(cfg *config.Config) error) {
+	l.overrides = append(l.overrides, fn)
+}
+
+func (l *configLoader) Load() (*config.Config, error) {
+	cfg := config.Default()
+	if l.path != "" {
+		loaded, err := config.Load(l.path)
+		if err != nil {
+			return nil, err
+		}
+		cfg = loaded
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	for _, fn := range l.overrides {
+		if err := fn(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configReloader applies a freshly loaded config to the running components.
+// A config that fails to load or validate is rejected and the current one kept.
+type configReloader struct {
+	mu           sync.Mutex
+	loader       *configLoader
+	current      *config.Config
+	version      int64
+	cacheManager *cache.Manager
+	rateLimiter  *ratelimit.Manager
+	proxy        *proxy.ReverseProxy
+	metrics      *metrics.Collector
+	warmer       *warm.Warmer
+}
+
+func (cr *configReloader) Reload(trigger string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	next, err := cr.loader.Load()
+	if err != nil {
+		log.Printf("Config reload (%s) rejected, keeping version %d: %v", trigger, cr.version, err)
+		cr.metrics.RecordConfigReload(false, cr.version)
+		return
+	}
+	if err := cr.proxy.Reload(next); err != nil {
+		log.Printf("Config reload (%s) rejected, keeping version %d: %v", trigger, cr.version, err)
+		cr.metrics.RecordConfigReload(false, cr.version)
+		return
+	}
+	if err := cr.rateLimiter.SetPolicies(rateLimitPolicies(next.RateLimit)); err != nil {
+		log.Printf("Config reload (%s): keeping previous rate limit policies: %v", trigger, err)
+	}
+	cr.cacheManager.SetTTL(next.Cache.TTL.Duration)
+	cr.cacheManager.SetStaleRetention(next.Cache.Retention())
+	cr.warmer.SetConfig(next.Cache.Warm)
+
+	if fields := cr.current.RestartRequired(next); len(fields) > 0 {
+		log.Printf("Config reload: changes to %s take effect after restart", strings.Join(fields, ", "))
+	}
+
+	cr.current = next
+	cr.version++
+	cr.metrics.RecordConfigReload(true, cr.version)
+	log.Printf("Config reloaded (%s), version %d: backend=%s routes=%d rate-limit=%d/min cache-ttl=%v",
+		trigger, cr.version, next.Backend.URL, len(next.RouteList()), next.RateLimit.RequestsPerMinute, next.Cache.TTL.Duration)
+}
+
+// setupLogging routes the standard logger through slog with the configured
+// level, format and output
+func setupLogging(cfg config.LoggingConfig) error {
+	var out io.Writer
+	switch cfg.Output {
+	case "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("opening log file: %w", err)
+		}
+		out = f
+	}
+
+	var level slog.Level
+	switch strings.ToLower(cfg.Level) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.ToLower(cfg.Format) == "json" {
+		handler = slog.NewJSONHandler(out, opts)
+	} else {
+		handler = slog.NewTextHandler(out, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
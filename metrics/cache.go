@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// cacheStats counts cache activity beyond plain hits and misses
+type cacheStats struct {
+	revalidatedNotModified int64
+	revalidatedModified    int64
+	notModifiedServed      int64
+	staleWhileRevalidate   int64
+	staleIfError           int64
+	staleMaxStale          int64
+	coalescedShared        int64
+	coalescedFallback      int64
+	coalescedTimeout       int64
+	purgedSoft             int64
+	purgedHard             int64
+	warmedOK               int64
+	warmedFailed           int64
+	// Indexed by status code
+	storedByStatus [600]int64
+	servedByStatus [600]int64
+}
+
+// IncrementCacheRevalidations counts a conditional request sent to the
+// backend for an expired entry, by whether it came back 304
+func (c *Collector) IncrementCacheRevalidations(notModified bool) {
+	if notModified {
+		atomic.AddInt64(&c.cache.revalidatedNotModified, 1)
+	} else {
+		atomic.AddInt64(&c.cache.revalidatedModified, 1)
+	}
+}
+
+// IncrementCacheNotModified counts 304s answered from the cache
+func (c *Collector) IncrementCacheNotModified() {
+	atomic.AddInt64(&c.cache.notModifiedServed, 1)
+}
+
+// IncrementCacheStaleServed counts a response served from an expired entry,
+// by reason: while_revalidate, if_error or max_stale
+func (c *Collector) IncrementCacheStaleServed(reason string) {
+	switch reason {
+	case "while_revalidate":
+		atomic.AddInt64(&c.cache.staleWhileRevalidate, 1)
+	case "if_error":
+		atomic.AddInt64(&c.cache.staleIfError, 1)
+	case "max_stale":
+		atomic.AddInt64(&c.cache.staleMaxStale, 1)
+	}
+}
+
+// IncrementCacheCoalesced counts a request that waited for another request's
+// fetch of the same key, by result: shared (served its response), fallback
+// (nothing shareable came back) or timeout
+func (c *Collector) IncrementCacheCoalesced(result string) {
+	switch result {
+	case "shared":
+		atomic.AddInt64(&c.cache.coalescedShared, 1)
+	case "fallback":
+		atomic.AddInt64(&c.cache.coalescedFallback, 1)
+	case "timeout":
+		atomic.AddInt64(&c.cache.coalescedTimeout, 1)
+	}
+}
+
+// AddCachePurged counts entries invalidated through the admin API, by
+// whether they were marked stale (soft) or deleted
+func (c *Collector) AddCachePurged(soft bool, n int) {
+	if soft {
+		atomic.AddInt64(&c.cache.purgedSoft, int64(n))
+	} else {
+		atomic.AddInt64(&c.cache.purgedHard, int64(n))
+	}
+}
+
+// IncrementCacheWarmed counts a URL fetched to warm the cache, by whether it
+// succeeded
+func (c *Collector) IncrementCacheWarmed(ok bool) {
+	if ok {
+		atomic.AddInt64(&c.cache.warmedOK, 1)
+	} else {
+		atomic.AddInt64(&c.cache.warmedFailed, 1)
+	}
+}
+
+// IncrementCacheStored counts a response stored in the cache, by status
+func (c *Collector) IncrementCacheStored(status int) {
+	if status >= 0 && status < len(c.cache.storedByStatus) {
+		atomic.AddInt64(&c.cache.storedByStatus[status], 1)
+	}
+}
+
+// IncrementCacheServed counts a response answered from a cache entry, by
+// the status of the entry
+func (c *Collector) IncrementCacheServed(status int) {
+	if status >= 0 && status < len(c.cache.servedByStatus) {
+		atomic.AddInt64(&c.cache.servedByStatus[status], 1)
+	}
+}
+
+// writeStatusCounts writes one line per status code seen so far
+func writeStatusCounts(w io.Writer, name string, counts *[600]int64) {
+	for status := range counts {
+		if n := atomic.LoadInt64(&counts[status]); n > 0 {
+			fmt.Fprintf(w, "%s{status=\"%d\"} %d\n", name, status, n)
+		}
+	}
+}
+
+// CacheStats is a snapshot of one cache storage tier's size and what it
+// has dropped
+type CacheStats struct {
+	Tier       string
+	Entries    int
+	Bytes      int64
+	Evictions  int64
+	Expired    int64
+	Rejected   int64
+	Promotions int64
+}
+
+// SetCacheStatsFunc registers where the cache size metrics are read from at
+// scrape time
+func (c *Collector) SetCacheStatsFunc(fn func() []CacheStats) {
+	c.cacheStatsFunc = fn
+}
+
+func (c *Collector) writeCacheMetrics(w io.Writer) {
+	if c.cacheStatsFunc != nil {
+		stats := c.cacheStatsFunc()
+		fmt.Fprint(w, "\n# HELP goproxy_cache_entries Entries currently cached, per storage tier\n# TYPE goproxy_cache_entries gauge\n")
+		for _, s := range stats {
+			fmt.Fprintf(w, "goproxy_cache_entries{tier=%q} %d\n", s.Tier, s.Entries)
+		}
+		fmt.Fprint(w, "\n# HELP goproxy_cache_bytes Approximate size of cached responses in bytes, per storage tier\n# TYPE goproxy_cache_bytes gauge\n")
+		for _, s := range stats {
+			fmt.Fprintf(w, "goproxy_cache_bytes{tier=%q} %d\n", s.Tier, s.Bytes)
+		}
+		fmt.Fprint(w, "\n# HELP goproxy_cache_evictions_total Entries dropped from the cache, by storage tier and reason\n# TYPE goproxy_cache_evictions_total counter\n")
+		for _, s := range stats {
+			fmt.Fprintf(w, "goproxy_cache_evictions_total{tier=%q,reason=\"capacity\"} %d\n", s.Tier, s.Evictions)
+			fmt.Fprintf(w, "goproxy_cache_evictions_total{tier=%q,reason=\"expired\"} %d\n", s.Tier, s.Expired)
+		}
+		fmt.Fprint(w, "\n# HELP goproxy_cache_rejected_total Responses not cached because they were too large or not admitted by the eviction policy\n# TYPE goproxy_cache_rejected_total counter\n")
+		for _, s := range stats {
+			fmt.Fprintf(w, "goproxy_cache_rejected_total{tier=%q} %d\n", s.Tier, s.Rejected)
+		}
+		if len(stats) > 1 {
+			fmt.Fprint(w, "\n# HELP goproxy_cache_promotions_total Disk cache hits copied into the memory tier\n# TYPE goproxy_cache_promotions_total counter\n")
+			fmt.Fprintf(w, "goproxy_cache_promotions_total %d\n", stats[0].Promotions)
+		}
+	}
+
+	fmt.Fprint(w, "\n# HELP goproxy_cache_revalidations_total Conditional requests sent to the backend for expired cache entries\n# TYPE goproxy_cache_revalidations_total counter\n")
+	fmt.Fprintf(w, "goproxy_cache_revalidations_total{result=\"not_modified\"} %d\n", atomic.LoadInt64(&c.cache.revalidatedNotModified))
+	fmt.Fprintf(w, "goproxy_cache_revalidations_total{result=\"modified\"} %d\n", atomic.LoadInt64(&c.cache.revalidatedModified))
+
+	fmt.Fprint(w, "\n# HELP goproxy_cache_not_modified_total 304 responses served from the cache to conditional client requests\n# TYPE goproxy_cache_not_modified_total counter\n")
+	fmt.Fprintf(w, "goproxy_cache_not_modified_total %d\n", atomic.LoadInt64(&c.cache.notModifiedServed))
+
+	fmt.Fprint(w, "\n# HELP goproxy_cache_stale_served_total Responses served from expired cache entries\n# TYPE goproxy_cache_stale_served_total counter\n")
+	fmt.Fprintf(w, "goproxy_cache_stale_served_total{reason=\"while_revalidate\"} %d\n", atomic.LoadInt64(&c.cache.staleWhileRevalidate))
+	fmt.Fprintf(w, "goproxy_cache_stale_served_total{reason=\"if_error\"} %d\n", atomic.LoadInt64(&c.cache.staleIfError))
+	fmt.Fprintf(w, "goproxy_cache_stale_served_total{reason=\"max_stale\"} %d\n", atomic.LoadInt64(&c.cache.staleMaxStale))
+
+	fmt.Fprint(w, "\n# HELP goproxy_cache_coalesced_total Requests that waited for an identical in-progress fetch instead of going to the backend\n# TYPE goproxy_cache_coalesced_total counter\n")
+	fmt.Fprintf(w, "goproxy_cache_coalesced_total{result=\"shared\"} %d\n", atomic.LoadInt64(&c.cache.coalescedShared))
+	fmt.Fprintf(w, "goproxy_cache_coalesced_total{result=\"fallback\"} %d\n", atomic.LoadInt64(&c.cache.coalescedFallback))
+	fmt.Fprintf(w, "goproxy_cache_coalesced_total{result=\"timeout\"} %d\n", atomic.LoadInt64(&c.cache.coalescedTimeout))
+
+	fmt.Fprint(w, "\n# HELP goproxy_cache_purged_total Cache entries invalidated through the admin API\n# TYPE goproxy_cache_purged_total counter\n")
+	fmt.Fprintf(w, "goproxy_cache_purged_total{mode=\"soft\"} %d\n", atomic.LoadInt64(&c.cache.purgedSoft))
+	fmt.Fprintf(w, "goproxy_cache_purged_total{mode=\"hard\"} %d\n", atomic.LoadInt64(&c.cache.purgedHard))
+
+	fmt.Fprint(w, "\n# HELP goproxy_cache_warmed_total URLs fetched to warm the cache, including hot URL refreshes\n# TYPE goproxy_cache_warmed_total counter\n")
+	fmt.Fprintf(w, "goproxy_cache_warmed_total{result=\"ok\"} %d\n", atomic.LoadInt64(&c.cache.warmedOK))
+	fmt.Fprintf(w, "goproxy_cache_warmed_total{result=\"failed\"} %d\n", atomic.LoadInt64(&c.cache.warmedFailed))
+
+	fmt.Fprint(w, "\n# HELP goproxy_cache_stored_total Responses stored in the cache, by status code\n# TYPE goproxy_cache_stored_total counter\n")
+	writeStatusCounts(w, "goproxy_cache_stored_total", &c.cache.storedByStatus)
+
+	fmt.Fprint(w, "\n# HELP goproxy_cache_served_total Responses answered from cache entries, by the status code of the entry\n# TYPE goproxy_cache_served_total counter\n")
+	writeStatusCounts(w, "goproxy_cache_served_total", &c.cache.servedByStatus)
+}
@@ -14,17 +14,40 @@ type Collector struct {
 	cacheHits        int64
 	cacheMisses      int64
 	blockedRequests  int64
+	configReloads    int64
+	configReloadFailures int64
+	configVersion    int64
+	configLastReload int64
+	inFlightRequests int64
+	cache            cacheStats
+	draining         int32
 	responseTimes    []time.Duration
 	responseTimeMutex sync.RWMutex
 
     recentRequests   []RequestLogEntry
     requestsMutex    sync.RWMutex
+    retention        time.Duration
+
+    upstreamStats    map[string]*targetStats
+    breakers         map[string]*breakerStats
+    retries          map[string]int64
+    retryBudgetExhausted map[string]int64
+    upstreamMutex    sync.RWMutex
+
+    cacheStatsFunc   func() []CacheStats
 }
 
-func New() *Collector {
+// New creates a collector. Request log entries older than retention are
+// dropped (0 keeps the last 200 regardless of age).
+func New(retention time.Duration) *Collector {
 	return &Collector{
 		responseTimes: make([]time.Duration, 0, 1000),
         recentRequests: make([]RequestLogEntry, 0, 200),
+        retention:      retention,
+        upstreamStats:  make(map[string]*targetStats),
+        breakers:       make(map[string]*breakerStats),
+        retries:        make(map[string]int64),
+        retryBudgetExhausted: make(map[string]int64),
 	}
 }
 
@@ -44,6 +67,44 @@ func (c *Collector) IncrementBlockedRequests() {
 	atomic.AddInt64(&c.blockedRequests, 1)
 }
 
+// RequestStarted and RequestFinished track proxied requests currently in flight
+func (c *Collector) RequestStarted() {
+	atomic.AddInt64(&c.inFlightRequests, 1)
+}
+
+func (c *Collector) RequestFinished() {
+	atomic.AddInt64(&c.inFlightRequests, -1)
+}
+
+func (c *Collector) InFlightRequests() int64 {
+	return atomic.LoadInt64(&c.inFlightRequests)
+}
+
+// SetDraining marks the server as shutting down
+func (c *Collector) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&c.draining, v)
+}
+
+// RecordConfigReload counts a reload attempt; on success version becomes the
+// active config version
+func (c *Collector) RecordConfigReload(success bool, version int64) {
+	if !success {
+		atomic.AddInt64(&c.configReloadFailures, 1)
+		return
+	}
+	atomic.AddInt64(&c.configReloads, 1)
+	atomic.StoreInt64(&c.configVersion, version)
+	atomic.StoreInt64(&c.configLastReload, time.Now().Unix())
+}
+
+func (c *Collector) SetConfigVersion(version int64) {
+	atomic.StoreInt64(&c.configVersion, version)
+}
+
 func (c *Collector) RecordResponseTime(duration time.Duration) {
 	c.responseTimeMutex.Lock()
 	defer c.responseTimeMutex.Unlock()
@@ -114,6 +175,30 @@ goproxy_response_time_samples %d
 # HELP goproxy_uptime_seconds Server uptime in seconds
 # TYPE goproxy_uptime_seconds counter
 goproxy_uptime_seconds %.0f
+
+# HELP goproxy_config_reloads_total Successful configuration reloads
+# TYPE goproxy_config_reloads_total counter
+goproxy_config_reloads_total %d
+
+# HELP goproxy_config_reload_failures_total Rejected configuration reloads
+# TYPE goproxy_config_reload_failures_total counter
+goproxy_config_reload_failures_total %d
+
+# HELP goproxy_config_version Version of the active configuration, incremented on each successful reload
+# TYPE goproxy_config_version gauge
+goproxy_config_version %d
+
+# HELP goproxy_config_last_reload_timestamp_seconds Unix time of the last successful reload
+# TYPE goproxy_config_last_reload_timestamp_seconds gauge
+goproxy_config_last_reload_timestamp_seconds %d
+
+# HELP goproxy_in_flight_requests Proxied requests currently being served
+# TYPE goproxy_in_flight_requests gauge
+goproxy_in_flight_requests %d
+
+# HELP goproxy_draining Whether the server is draining for shutdown (1) or serving (0)
+# TYPE goproxy_draining gauge
+goproxy_draining %d
 `,
 		totalRequests,
 		cacheHits,
@@ -123,9 +208,17 @@ goproxy_uptime_seconds %.0f
 		float64(avgResponseTime.Microseconds())/1000.0, // Convert to milliseconds
 		responseTimeCount,
 		float64(time.Since(startTime).Seconds()),
+		atomic.LoadInt64(&c.configReloads),
+		atomic.LoadInt64(&c.configReloadFailures),
+		atomic.LoadInt64(&c.configVersion),
+		atomic.LoadInt64(&c.configLastReload),
+		atomic.LoadInt64(&c.inFlightRequests),
+		atomic.LoadInt32(&c.draining),
 	)
 	
 	w.Write([]byte(metrics))
+	c.writeCacheMetrics(w)
+	c.writeUpstreamMetrics(w)
 }
 
 // Simple JSON metrics endpoint
@@ -160,7 +253,12 @@ func (c *Collector) HandleJSONMetrics(w http.ResponseWriter, r *http.Request) {
   "blocked_requests": %d,
   "cache_hit_rate": %.2f,
   "average_response_time_ms": %.2f,
-  "uptime_seconds": %.0f
+  "uptime_seconds": %.0f,
+  "config_version": %d,
+  "config_reloads": %d,
+  "config_reload_failures": %d,
+  "in_flight_requests": %d,
+  "draining": %t
 }`,
 		totalRequests,
 		cacheHits,
@@ -169,6 +267,11 @@ func (c *Collector) HandleJSONMetrics(w http.ResponseWriter, r *http.Request) {
 		cacheHitRate,
 		float64(avgResponseTime.Microseconds())/1000.0,
 		float64(time.Since(startTime).Seconds()),
+		atomic.LoadInt64(&c.configVersion),
+		atomic.LoadInt64(&c.configReloads),
+		atomic.LoadInt64(&c.configReloadFailures),
+		atomic.LoadInt64(&c.inFlightRequests),
+		atomic.LoadInt32(&c.draining) == 1,
 	)
 	
 	w.Write([]byte(json))
@@ -186,6 +289,7 @@ type RequestLogEntry struct {
     Bytes       int       `json:"bytes"`
     Host        string    `json:"host"`
     Scheme      string    `json:"scheme"`
+    Route       string    `json:"route"`
     UserAgent   string    `json:"user_agent"`
     Referer     string    `json:"referer"`
     ContentType string    `json:"content_type"`
@@ -201,16 +305,33 @@ func (c *Collector) AddRequestLog(entry RequestLogEntry) {
         c.recentRequests = c.recentRequests[1:]
     }
     c.recentRequests = append(c.recentRequests, entry)
+    c.pruneExpiredLocked(time.Now())
+}
+
+// pruneExpiredLocked drops entries older than the retention period
+func (c *Collector) pruneExpiredLocked(now time.Time) {
+    if c.retention <= 0 {
+        return
+    }
+    cutoff := now.Add(-c.retention)
+    i := 0
+    for i < len(c.recentRequests) && c.recentRequests[i].Timestamp.Before(cutoff) {
+        i++
+    }
+    if i > 0 {
+        c.recentRequests = append(c.recentRequests[:0], c.recentRequests[i:]...)
+    }
 }
 
 // HandleRecentRequests returns recent request logs in JSON
 func (c *Collector) HandleRecentRequests(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
-    c.requestsMutex.RLock()
+    c.requestsMutex.Lock()
+    c.pruneExpiredLocked(time.Now())
     // copy to avoid holding lock during marshal
     snapshot := make([]RequestLogEntry, len(c.recentRequests))
     copy(snapshot, c.recentRequests)
-    c.requestsMutex.RUnlock()
+    c.requestsMutex.Unlock()
 
     enc := json.NewEncoder(w)
     enc.SetIndent("", "  ")
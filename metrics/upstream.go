@@ -0,0 +1,257 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// targetStats holds per-target counters for an upstream pool
+type targetStats struct {
+	upstream string
+	target   string
+	requests int64
+	inFlight int64
+	errors   int64
+	// healthy is -1 until a health state is reported, then 0 or 1
+	healthy int32
+}
+
+func (c *Collector) targetStats(upstream, target string) *targetStats {
+	key := upstream + "|" + target
+	c.upstreamMutex.RLock()
+	stats, ok := c.upstreamStats[key]
+	c.upstreamMutex.RUnlock()
+	if ok {
+		return stats
+	}
+
+	c.upstreamMutex.Lock()
+	defer c.upstreamMutex.Unlock()
+	if stats, ok := c.upstreamStats[key]; ok {
+		return stats
+	}
+	stats = &targetStats{upstream: upstream, target: target, healthy: -1}
+	c.upstreamStats[key] = stats
+	return stats
+}
+
+// UpstreamRequestStarted records a request sent to target in upstream
+func (c *Collector) UpstreamRequestStarted(upstream, target string) {
+	stats := c.targetStats(upstream, target)
+	atomic.AddInt64(&stats.requests, 1)
+	atomic.AddInt64(&stats.inFlight, 1)
+}
+
+// UpstreamRequestFinished records the end of a request; failed means a
+// connection error or 5xx response
+func (c *Collector) UpstreamRequestFinished(upstream, target string, failed bool) {
+	stats := c.targetStats(upstream, target)
+	atomic.AddInt64(&stats.inFlight, -1)
+	if failed {
+		atomic.AddInt64(&stats.errors, 1)
+	}
+}
+
+// SetUpstreamHealth records the active health check result for a target
+func (c *Collector) SetUpstreamHealth(upstream, target string, healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&c.targetStats(upstream, target).healthy, v)
+}
+
+// breakerStats holds circuit breaker state for one upstream
+type breakerStats struct {
+	state       int32
+	transitions map[string]int64
+	rejected    int64
+}
+
+func (c *Collector) breakerStats(upstream string) *breakerStats {
+	c.upstreamMutex.Lock()
+	defer c.upstreamMutex.Unlock()
+	stats, ok := c.breakers[upstream]
+	if !ok {
+		stats = &breakerStats{transitions: make(map[string]int64)}
+		c.breakers[upstream] = stats
+	}
+	return stats
+}
+
+// SetBreakerState records the current circuit state (0 closed, 1 open,
+// 2 half-open) without counting a transition
+func (c *Collector) SetBreakerState(upstream string, state int) {
+	atomic.StoreInt32(&c.breakerStats(upstream).state, int32(state))
+}
+
+// RecordBreakerTransition counts a circuit state change
+func (c *Collector) RecordBreakerTransition(upstream, from, to string, state int) {
+	stats := c.breakerStats(upstream)
+	atomic.StoreInt32(&stats.state, int32(state))
+	c.upstreamMutex.Lock()
+	stats.transitions[from+"|"+to]++
+	c.upstreamMutex.Unlock()
+}
+
+// IncrementBreakerRejected counts a request failed fast by an open circuit
+func (c *Collector) IncrementBreakerRejected(upstream string) {
+	atomic.AddInt64(&c.breakerStats(upstream).rejected, 1)
+}
+
+func (c *Collector) writeBreakerMetrics(w io.Writer) {
+	c.upstreamMutex.RLock()
+	defer c.upstreamMutex.RUnlock()
+	if len(c.breakers) == 0 {
+		return
+	}
+	names := make([]string, 0, len(c.breakers))
+	for name := range c.breakers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprint(w, "\n# HELP goproxy_circuit_breaker_state Circuit breaker state per upstream (0 closed, 1 open, 2 half-open)\n# TYPE goproxy_circuit_breaker_state gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "goproxy_circuit_breaker_state{upstream=%q} %d\n", name, atomic.LoadInt32(&c.breakers[name].state))
+	}
+	fmt.Fprint(w, "\n# HELP goproxy_circuit_breaker_rejected_total Requests failed fast by an open circuit\n# TYPE goproxy_circuit_breaker_rejected_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "goproxy_circuit_breaker_rejected_total{upstream=%q} %d\n", name, atomic.LoadInt64(&c.breakers[name].rejected))
+	}
+	fmt.Fprint(w, "\n# HELP goproxy_circuit_breaker_transitions_total Circuit breaker state changes\n# TYPE goproxy_circuit_breaker_transitions_total counter\n")
+	for _, name := range names {
+		keys := make([]string, 0, len(c.breakers[name].transitions))
+		for k := range c.breakers[name].transitions {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			from, to, _ := strings.Cut(k, "|")
+			fmt.Fprintf(w, "goproxy_circuit_breaker_transitions_total{upstream=%q,from=%q,to=%q} %d\n", name, from, to, c.breakers[name].transitions[k])
+		}
+	}
+}
+
+// IncrementRetries counts a retried upstream attempt for route
+func (c *Collector) IncrementRetries(route string) {
+	c.upstreamMutex.Lock()
+	c.retries[route]++
+	c.upstreamMutex.Unlock()
+}
+
+// IncrementRetryBudgetExhausted counts a retry skipped because the retry
+// budget was used up
+func (c *Collector) IncrementRetryBudgetExhausted(route string) {
+	c.upstreamMutex.Lock()
+	c.retryBudgetExhausted[route]++
+	c.upstreamMutex.Unlock()
+}
+
+func (c *Collector) writeRetryMetrics(w io.Writer) {
+	c.upstreamMutex.RLock()
+	defer c.upstreamMutex.RUnlock()
+	writeRouteCounter(w, "goproxy_retries_total", "Upstream attempts retried, per route", c.retries)
+	writeRouteCounter(w, "goproxy_retry_budget_exhausted_total", "Retries skipped because the retry budget was exhausted, per route", c.retryBudgetExhausted)
+}
+
+func writeRouteCounter(w io.Writer, name, help string, values map[string]int64) {
+	if len(values) == 0 {
+		return
+	}
+	routes := make([]string, 0, len(values))
+	for route := range values {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	fmt.Fprintf(w, "\n# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, route := range routes {
+		fmt.Fprintf(w, "%s{route=%q} %d\n", name, route, values[route])
+	}
+}
+
+// sortedTargetStats returns a stable snapshot for output
+func (c *Collector) sortedTargetStats() []*targetStats {
+	c.upstreamMutex.RLock()
+	list := make([]*targetStats, 0, len(c.upstreamStats))
+	for _, stats := range c.upstreamStats {
+		list = append(list, stats)
+	}
+	c.upstreamMutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].upstream != list[j].upstream {
+			return list[i].upstream < list[j].upstream
+		}
+		return list[i].target < list[j].target
+	})
+	return list
+}
+
+func (c *Collector) writeUpstreamMetrics(w io.Writer) {
+	c.writeBreakerMetrics(w)
+	c.writeRetryMetrics(w)
+
+	list := c.sortedTargetStats()
+	if len(list) == 0 {
+		return
+	}
+
+	fmt.Fprint(w, "\n# HELP goproxy_upstream_requests_total Requests sent to each upstream target\n# TYPE goproxy_upstream_requests_total counter\n")
+	for _, s := range list {
+		fmt.Fprintf(w, "goproxy_upstream_requests_total{upstream=%q,target=%q} %d\n", s.upstream, s.target, atomic.LoadInt64(&s.requests))
+	}
+	fmt.Fprint(w, "\n# HELP goproxy_upstream_in_flight Requests currently in flight to each upstream target\n# TYPE goproxy_upstream_in_flight gauge\n")
+	for _, s := range list {
+		fmt.Fprintf(w, "goproxy_upstream_in_flight{upstream=%q,target=%q} %d\n", s.upstream, s.target, atomic.LoadInt64(&s.inFlight))
+	}
+	fmt.Fprint(w, "\n# HELP goproxy_upstream_errors_total Connection errors and 5xx responses from each upstream target\n# TYPE goproxy_upstream_errors_total counter\n")
+	for _, s := range list {
+		fmt.Fprintf(w, "goproxy_upstream_errors_total{upstream=%q,target=%q} %d\n", s.upstream, s.target, atomic.LoadInt64(&s.errors))
+	}
+	fmt.Fprint(w, "\n# HELP goproxy_upstream_healthy Active health check state of each upstream target (1 healthy, 0 unhealthy)\n# TYPE goproxy_upstream_healthy gauge\n")
+	for _, s := range list {
+		if healthy := atomic.LoadInt32(&s.healthy); healthy >= 0 {
+			fmt.Fprintf(w, "goproxy_upstream_healthy{upstream=%q,target=%q} %d\n", s.upstream, s.target, healthy)
+		}
+	}
+}
+
+// UpstreamStatus is the JSON form of a target's stats
+type UpstreamStatus struct {
+	Upstream string `json:"upstream"`
+	Target   string `json:"target"`
+	Healthy  *bool  `json:"healthy"`
+	Requests int64  `json:"requests"`
+	InFlight int64  `json:"in_flight"`
+	Errors   int64  `json:"errors"`
+}
+
+// HandleUpstreams returns per-target upstream stats in JSON
+func (c *Collector) HandleUpstreams(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	list := c.sortedTargetStats()
+	out := make([]UpstreamStatus, 0, len(list))
+	for _, s := range list {
+		status := UpstreamStatus{
+			Upstream: s.upstream,
+			Target:   s.target,
+			Requests: atomic.LoadInt64(&s.requests),
+			InFlight: atomic.LoadInt64(&s.inFlight),
+			Errors:   atomic.LoadInt64(&s.errors),
+		}
+		if healthy := atomic.LoadInt32(&s.healthy); healthy >= 0 {
+			h := healthy == 1
+			status.Healthy = &h
+		}
+		out = append(out, status)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(out)
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"goproxy/cache"
+)
+
+// purgeRequest is the body of POST /admin/cache/purge
+type purgeRequest struct {
+	Keys     []string `json:"keys"`
+	Prefixes []string `json:"prefixes"`
+	Globs    []string `json:"globs"`
+	Tags     []string `json:"tags"`
+	// All selects every entry
+	All bool `json:"all"`
+	// Soft marks entries stale instead of deleting them
+	Soft bool `json:"soft"`
+}
+
+// HandlePurge invalidates cache entries by key, URL prefix, glob or
+// surrogate-key tag, e.g.
+//
+//	{"tags": ["article-42"], "soft": true}
+func (rp *ReverseProxy) HandlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req purgeRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, "Invalid purge request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	table := rp.routes.Load()
+	sel := cache.PurgeSelector{
+		Keys:     table.upstreamPatterns(req.Keys),
+		Prefixes: table.upstreamPatterns(req.Prefixes),
+		Globs:    table.upstreamPatterns(req.Globs),
+		Tags:     req.Tags,
+	}
+	if req.All {
+		sel.Prefixes = []string{""}
+	}
+	if len(sel.Keys)+len(sel.Prefixes)+len(sel.Globs)+len(sel.Tags) == 0 {
+		http.Error(w, "Invalid purge request: nothing selected (set keys, prefixes, globs, tags or all)", http.StatusBadRequest)
+		return
+	}
+
+	purged := rp.cacheManager.Purge(sel, req.Soft)
+	rp.metricsCollector.AddCachePurged(req.Soft, purged)
+	mode := "hard"
+	if req.Soft {
+		mode = "soft"
+	}
+	log.Printf("Cache purge (%s) from %s: %d entries (keys=%q prefixes=%q globs=%q tags=%q all=%v)",
+		mode, r.RemoteAddr, purged, req.Keys, req.Prefixes, req.Globs, req.Tags, req.All)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Purged int    `json:"purged"`
+		Mode   string `json:"mode"`
+	}{purged, mode})
+}
+
+// upstreamPatterns adds to URL patterns, as the client requests them, the
+// same patterns as cached by each route that strips or rewrites the path:
+// the route name and the path sent upstream. A purge for /proxy/foo/* then
+// finds entries a route stripping /proxy cached as route|/foo/...
+func (t *routeTable) upstreamPatterns(patterns []string) []string {
+	out := append([]string(nil), patterns...)
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "/") {
+			continue
+		}
+		path, query, hasQuery := strings.Cut(pattern, "?")
+		for _, rt := range t.routes {
+			if rt.stripPrefix == "" && rt.rewritePrefix == "" || !strings.HasPrefix(path, rt.pathPrefix) {
+				continue
+			}
+			rewritten := rt.name + "|" + rt.rewritePath(path)
+			if hasQuery {
+				rewritten += "?" + query
+			}
+			out = append(out, rewritten)
+		}
+	}
+	return out
+}
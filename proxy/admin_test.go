@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUpstreamPatterns(t *testing.T) {
+	table := &routeTable{routes: []*route{
+		{name: "p", pathPrefix: "/proxy/", stripPrefix: "/proxy"},
+		{name: "v", pathPrefix: "/v1/", stripPrefix: "/v1", rewritePrefix: "/api/v1/"},
+		{name: "plain", pathPrefix: "/static/"},
+	}}
+	tests := []struct {
+		patterns []string
+		want     []string
+	}{
+		{[]string{"/proxy/foo/*"}, []string{"/proxy/foo/*", "p|/foo/*"}},
+		{[]string{"/v1/x?q=1"}, []string{"/v1/x?q=1", "v|/api/v1/x?q=1"}},
+		// Routes that don't rewrite cache the client's path already
+		{[]string{"/static/app.js"}, []string{"/static/app.js"}},
+		{[]string{"p|/foo", "*.css"}, []string{"p|/foo", "*.css"}},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		if got := table.upstreamPatterns(tt.patterns); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("upstreamPatterns(%q) = %q, want %q", tt.patterns, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"goproxy/cache"
+	"goproxy/metrics"
+)
+
+// Warning headers for responses served stale (RFC 7234 section 5.5)
+const (
+	warningStale              = `110 goproxy "Response is Stale"`
+	warningRevalidationFailed = `111 goproxy "Revalidation Failed"`
+)
+
+// backgroundRefreshTimeout bounds a stale-while-revalidate refresh, which has
+// no client request to inherit a deadline from
+const backgroundRefreshTimeout = 30 * time.Second
+
+// lookupCache returns the stored response for key that r may be answered
+// from, fresh or not, or nil. It is looked up once per request so the
+// eviction policy counts a single use.
+func (rp *ReverseProxy) lookupCache(key string, r *http.Request) *cache.Response {
+	cached := rp.cacheManager.LookupStale(key, r.Header)
+	if cached == nil {
+		return nil
+	}
+	if cache.HasCredentials(r.Header) && !cached.Shareable && !requestFromContext(r.Context()).route.perUser(r) {
+		return nil
+	}
+	return cached
+}
+
+// storeResponse caches a response fetched for r if RFC 9111 allows a shared
+// cache to store it and the route caches its status, for as long as the
+// origin says it stays fresh (or the route's status TTL if it doesn't).
+// Responses that are already stale (or marked no-cache) are kept for
+// revalidation only if they carry validators.
+func (rp *ReverseProxy) storeResponse(key string, r *http.Request, resp *cache.Response) {
+	header := http.Header(resp.Headers)
+	rt := requestFromContext(r.Context()).route
+	lifetime, ok := rt.statusTTL.lifetime(resp.StatusCode, rp.cacheManager.TTL())
+	if !ok || !cache.Storable(r.Header, header, rt.perUser(r)) {
+		return
+	}
+	respCC := cache.ParseCacheControl(header)
+	resp.InitialAge = cache.InitialAge(header, resp.StoredAt)
+	resp.Shareable = cache.ExplicitlyShareable(respCC)
+	ttl := cache.FreshnessLifetime(header, lifetime) - resp.InitialAge
+	if respCC.Has("no-cache") || ttl < 0 {
+		ttl = 0
+	}
+	if ttl == 0 && (!resp.Validators() || rp.cacheManager.StaleRetention() <= 0) {
+		return
+	}
+	vary, _ := cache.VaryHeaders(header)
+	rp.cacheManager.Store(key, vary, r.Header, resp, ttl)
+	rp.metricsCollector.IncrementCacheStored(resp.StatusCode)
+}
+
+// fetch forwards r to the backend through capture and caches the result. If
+// stale has validators the request revalidates it: a 304 is held back from
+// the client and the refreshed entry returned instead, with nothing written.
+func (rp *ReverseProxy) fetch(capture *responseCapture, r *http.Request, key string, stale *cache.Response) *cache.Response {
+	outReq := r
+	revalidating := stale != nil && stale.Validators()
+	if revalidating {
+		outReq = conditionalRequest(r, stale)
+		capture.holdNotModified = true
+	}
+
+	// Only tee bodies that can be cached, and only up to the object size
+	// limit. Event streams never end, so they are never cached.
+	pr := requestFromContext(r.Context())
+	capture.teeIf = func(statusCode int, header http.Header) bool {
+		_, cacheable := pr.route.statusTTL.lifetime(statusCode, 0)
+		return cacheable && cache.Storable(r.Header, header, pr.route.perUser(r)) &&
+			!strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+	}
+	capture.teeLimit = pr.table.maxObjectBytes
+
+	rp.forward(capture, outReq)
+
+	notModified := capture.held && capture.statusCode == http.StatusNotModified
+	if revalidating {
+		rp.metricsCollector.IncrementCacheRevalidations(notModified)
+	}
+	if notModified {
+		return rp.refreshResponse(key, r, stale, capture.headers)
+	}
+	if !capture.held && capture.body != nil {
+		rp.storeResponse(key, r, &cache.Response{
+			StatusCode: capture.statusCode,
+			Headers:    capture.headers,
+			Body:       capture.body.Bytes(),
+			StoredAt:   time.Now(),
+		})
+	}
+	return nil
+}
+
+// waitForFetch waits up to timeout for another request's fetch of key to
+// finish and returns the response it cached, or nil if there is nothing to
+// share and the caller should fetch for itself
+func (rp *ReverseProxy) waitForFetch(r *http.Request, key string, done <-chan struct{}, timeout time.Duration) *cache.Response {
+	waitStart := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		rp.metricsCollector.IncrementCacheCoalesced("timeout")
+		return nil
+	case <-r.Context().Done():
+		return nil
+	}
+
+	shared := rp.cacheManager.Lookup(key, r.Header)
+	if shared == nil || shared.StoredAt.Before(waitStart) {
+		// The fetch got nothing cacheable (an error, or a private response)
+		rp.metricsCollector.IncrementCacheCoalesced("fallback")
+		return nil
+	}
+	rp.metricsCollector.IncrementCacheCoalesced("shared")
+	return shared
+}
+
+// refreshInBackground refetches key off the request path, revalidating stale
+// if possible. Nothing happens if a fetch of key is already in progress.
+func (rp *ReverseProxy) refreshInBackground(key string, r *http.Request, stale *cache.Response) {
+	if _, leader := rp.cacheManager.BeginFetch(key); !leader {
+		return
+	}
+	pr := requestFromContext(r.Context())
+	bg := &proxyRequest{table: pr.table, route: pr.route, clientIP: pr.clientIP, debugCacheKey: pr.debugCacheKey}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), requestContextKey, bg), backgroundRefreshTimeout)
+	req := r.Clone(ctx)
+	// A HEAD served stale still refreshes the full entry
+	req.Method = http.MethodGet
+	req.Body = http.NoBody
+	go func() {
+		defer rp.cacheManager.EndFetch(key)
+		defer cancel()
+		rp.fetch(newResponseCapture(discardWriter{header: make(http.Header)}), req, key, stale)
+	}()
+}
+
+// fillAfterRange fetches the full object in the background after a range
+// request missed, so later ranges can be served from the cache. partial is
+// the backend's 206; objects too large to cache are left alone.
+func (rp *ReverseProxy) fillAfterRange(key string, r *http.Request, partial http.Header) {
+	total := rangeTotal(partial.Get("Content-Range"))
+	pr := requestFromContext(r.Context())
+	limit := pr.table.maxObjectBytes
+	if total < 0 || limit > 0 && total > limit || !cache.Storable(r.Header, partial, pr.route.perUser(r)) {
+		return
+	}
+	full := r.Clone(r.Context())
+	full.Header.Del("Range")
+	full.Header.Del("If-Range")
+	rp.refreshInBackground(key, full, nil)
+}
+
+// rangeTotal returns the complete length from a Content-Range header such as
+// "bytes 0-99/1234", or -1 if it is unknown
+func rangeTotal(contentRange string) int64 {
+	_, total, ok := strings.Cut(contentRange, "/")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// discardWriter is the client end of a background refresh
+type discardWriter struct {
+	header http.Header
+}
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d discardWriter) WriteHeader(int)             {}
+
+// conditionalRequest returns a copy of r that asks the backend whether stale
+// has changed. The client's own validators are replaced; they are evaluated
+// against the refreshed entry instead.
+func conditionalRequest(r *http.Request, stale *cache.Response) *http.Request {
+	out := r.Clone(r.Context())
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	stored := http.Header(stale.Headers)
+	if etag := stored.Get("ETag"); etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := stored.Get("Last-Modified"); lastModified != "" {
+		out.Header.Set("If-Modified-Since", lastModified)
+	}
+	return out
+}
+
+// refreshResponse stores stale again with the headers of the backend's 304
+// and returns the refreshed entry
+func (rp *ReverseProxy) refreshResponse(key string, r *http.Request, stale *cache.Response, notModified http.Header) *cache.Response {
+	refreshed := &cache.Response{
+		StatusCode: stale.StatusCode,
+		Headers:    cache.UpdateHeaders(stale.Headers, notModified),
+		Body:       stale.Body,
+		StoredAt:   time.Now(),
+	}
+	rp.storeResponse(key, r, refreshed)
+	return refreshed
+}
+
+// writeCached serves a cached response, answering the client's own
+// conditional request with 304 when its validators still match. Complete
+// 200 responses also answer HEAD and (multi-)range requests, honoring
+// If-Range.
+func (rp *ReverseProxy) writeCached(w http.ResponseWriter, r *http.Request, cached *cache.Response) (status, n int) {
+	header := w.Header()
+	for key, values := range cached.Headers {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	setAge(header, cached)
+	// Entries stored while the route had debug on carry the header too
+	header.Del("X-Cache-Key")
+	if key := requestFromContext(r.Context()).debugCacheKey; key != "" {
+		header.Set("X-Cache-Key", key)
+	}
+	if cached.StatusCode == http.StatusOK {
+		return rp.serveContent(w, r, cached)
+	}
+	if cache.NotModified(r.Header, cached.Headers) {
+		header.Del("Content-Length")
+		rp.metricsCollector.IncrementCacheNotModified()
+		w.WriteHeader(http.StatusNotModified)
+		return http.StatusNotModified, 0
+	}
+	w.WriteHeader(cached.StatusCode)
+	if r.Method != http.MethodHead {
+		n, _ = w.Write(cached.Body)
+	}
+	return cached.StatusCode, n
+}
+
+// serveContent answers r from a complete cached body with http.ServeContent,
+// which handles conditional, HEAD and range requests
+func (rp *ReverseProxy) serveContent(w http.ResponseWriter, r *http.Request, cached *cache.Response) (status, n int) {
+	header := w.Header()
+	if _, ok := header["Content-Type"]; !ok {
+		// Don't let ServeContent sniff a type the origin didn't send
+		header["Content-Type"] = nil
+	}
+	// ServeContent sets the length of what it sends, except for encoded
+	// bodies, where the stored length would be wrong for a range
+	header.Del("Content-Length")
+	modTime, _ := http.ParseTime(header.Get("Last-Modified"))
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	http.ServeContent(rec, r, "", modTime, bytes.NewReader(cached.Body))
+	if rec.status == http.StatusNotModified {
+		rp.metricsCollector.IncrementCacheNotModified()
+	}
+	return rec.status, rec.written
+}
+
+// statusRecorder notes the status and size of a response written by
+// http.ServeContent
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int
+}
+
+func (s *statusRecorder) WriteHeader(statusCode int) {
+	s.status = statusCode
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(p)
+	s.written += n
+	return n, err
+}
+
+// logCached records a GET answered from a cache entry in the request log
+func (rp *ReverseProxy) logCached(r *http.Request, start time.Time, status, n int, cached *cache.Response, hit bool) {
+	pr := requestFromContext(r.Context())
+	rp.metricsCollector.IncrementCacheServed(cached.StatusCode)
+	duration := time.Since(start)
+	remaining := time.Until(cached.ExpiresAt)
+	if remaining < 0 {
+		remaining = 0
+	}
+	host, scheme := pr.logHost()
+	rp.metricsCollector.RecordResponseTime(duration)
+	rp.metricsCollector.AddRequestLog(metrics.RequestLogEntry{
+		Timestamp:           time.Now(),
+		Method:              r.Method,
+		Path:                r.URL.String(),
+		Status:              status,
+		ClientIP:            pr.clientIP,
+		DurationMs:          float64(duration.Microseconds()) / 1000.0,
+		CacheHit:            hit,
+		Bytes:               n,
+		Host:                host,
+		Scheme:              scheme,
+		Route:               pr.route.name,
+		UserAgent:           r.UserAgent(),
+		Referer:             r.Referer(),
+		ContentType:         http.Header(cached.Headers).Get("Content-Type"),
+		CacheTTLRemainingMs: float64(remaining.Microseconds()) / 1000.0,
+	})
+}
+
+// setAge sets the Age header of a response served from the cache
+func setAge(h http.Header, cached *cache.Response) {
+	h.Set("Age", strconv.FormatInt(int64(cached.Age(time.Now())/time.Second), 10))
+}
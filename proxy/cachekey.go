@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"goproxy/config"
+)
+
+// cacheKeyTemplate is a compiled config.CacheKeyConfig
+type cacheKeyTemplate struct {
+	include   []string
+	exclude   []string
+	sortQuery bool
+	lowercase bool
+	headers   []string
+	cookies   []string
+	identity  bool
+	debug     bool
+}
+
+func newCacheKeyTemplate(c *config.CacheKeyConfig) *cacheKeyTemplate {
+	t := &cacheKeyTemplate{
+		include:   c.QueryInclude,
+		exclude:   c.QueryExclude,
+		sortQuery: c.SortQuery,
+		lowercase: c.Lowercase,
+		cookies:   c.Cookies,
+		identity:  c.Identity,
+		debug:     c.Debug,
+	}
+	for _, name := range c.Headers {
+		t.headers = append(t.headers, http.CanonicalHeaderKey(name))
+	}
+	return t
+}
+
+// cacheKey returns the key a GET for r is cached under: the route name and
+// the URL, shaped by the route's cache_key template if it has one
+func (rt *route) cacheKey(r *http.Request) string {
+	if rt.keyTemplate == nil {
+		return rt.name + "|" + r.URL.String()
+	}
+	return rt.name + "|" + rt.keyTemplate.build(r)
+}
+
+// perUser reports whether the credentials r carries are all part of its
+// cache key: Authorization through identity, and every cookie through the
+// cookies listed. Responses for such requests can be cached, since they are
+// only served back to the same user.
+func (rt *route) perUser(r *http.Request) bool {
+	t := rt.keyTemplate
+	if t == nil {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !t.identity {
+		return false
+	}
+	return t.keysCookies(r)
+}
+
+// keysCookies reports whether every cookie r sends is one the key includes
+func (t *cacheKeyTemplate) keysCookies(r *http.Request) bool {
+	sent := 0
+	for _, line := range r.Header.Values("Cookie") {
+		for _, part := range strings.Split(line, ";") {
+			if strings.TrimSpace(part) != "" {
+				sent++
+			}
+		}
+	}
+	cookies := r.Cookies()
+	// A cookie that doesn't parse isn't in the key either
+	if len(cookies) != sent {
+		return false
+	}
+	seen := make(map[string]bool, len(cookies))
+	for _, c := range cookies {
+		// Only the first of repeated cookies is in the key
+		if seen[c.Name] || !containsValue(t.cookies, c.Name) {
+			return false
+		}
+		seen[c.Name] = true
+	}
+	return true
+}
+
+// build renders the key for r. Headers, cookies and identity follow the URL
+// separated by spaces, which never appear unescaped in a URL. Cookie and
+// Authorization values are hashed so they don't show up in X-Cache-Key or
+// the disk cache index.
+func (t *cacheKeyTemplate) build(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.URL.EscapedPath())
+	if query := t.query(r.URL.RawQuery); query != "" {
+		b.WriteString("?")
+		b.WriteString(query)
+	}
+	key := b.String()
+	if t.lowercase {
+		key = strings.ToLower(key)
+	}
+	b.Reset()
+	b.WriteString(key)
+
+	for _, name := range t.headers {
+		b.WriteString(" h:" + name + "=" + url.QueryEscape(strings.Join(r.Header.Values(name), ",")))
+	}
+	for _, name := range t.cookies {
+		value := ""
+		if c, err := r.Cookie(name); err == nil {
+			value = hashKeyValue(c.Value)
+		}
+		b.WriteString(" c:" + name + "=" + value)
+	}
+	if t.identity {
+		value := ""
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			value = hashKeyValue(auth)
+		}
+		b.WriteString(" id=" + value)
+	}
+	return b.String()
+}
+
+// query filters and orders the raw query, leaving each parameter's encoding
+// as the client sent it
+func (t *cacheKeyTemplate) query(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	var params []string
+	for _, param := range strings.Split(raw, "&") {
+		if param == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if len(t.include) > 0 && !matchParam(t.include, name) || matchParam(t.exclude, name) {
+			continue
+		}
+		params = append(params, param)
+	}
+	if t.sortQuery {
+		sort.Strings(params)
+	}
+	return strings.Join(params, "&")
+}
+
+// matchParam reports whether name is in patterns, where a trailing *
+// matches any suffix
+func matchParam(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasPrefix(name, prefix) || p == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hashKeyValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
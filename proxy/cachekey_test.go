@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"goproxy/cache"
+	"goproxy/config"
+)
+
+func TestPerUser(t *testing.T) {
+	lang := newCacheKeyTemplate(&config.CacheKeyConfig{Cookies: []string{"lang"}})
+	session := newCacheKeyTemplate(&config.CacheKeyConfig{Cookies: []string{"lang", "session"}, Identity: true})
+	tests := []struct {
+		name     string
+		template *cacheKeyTemplate
+		headers  []string
+		want     bool
+	}{
+		{"no template", nil, nil, false},
+		{"no credentials", lang, nil, true},
+		{"listed cookie", lang, []string{"Cookie", "lang=en"}, true},
+		{"unlisted session cookie", lang, []string{"Cookie", "lang=en; session=abc"}, false},
+		{"unlisted cookie in another header", lang, []string{"Cookie", "lang=en", "Cookie", "session=abc"}, false},
+		{"every cookie listed", session, []string{"Cookie", "session=abc; lang=en"}, true},
+		{"repeated cookie", session, []string{"Cookie", "session=abc; session=def"}, false},
+		{"unparsable cookie", session, []string{"Cookie", "session=abc; not a cookie"}, false},
+		{"authorization without identity", lang, []string{"Authorization", "Bearer a"}, false},
+		{"authorization with identity", session, []string{"Authorization", "Bearer a", "Cookie", "session=abc"}, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		for i := 0; i < len(tt.headers); i += 2 {
+			r.Header.Add(tt.headers[i], tt.headers[i+1])
+		}
+		rt := &route{name: "r", keyTemplate: tt.template}
+		if got := rt.perUser(r); got != tt.want {
+			t.Errorf("%s: perUser = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A response for a session the key doesn't cover must not be stored under
+// the shared key
+func TestUnlistedCookieNotStored(t *testing.T) {
+	rt := &route{name: "r", keyTemplate: newCacheKeyTemplate(&config.CacheKeyConfig{Cookies: []string{"lang"}})}
+	r := httptest.NewRequest("GET", "/account", nil)
+	r.Header.Set("Cookie", "lang=en; session=alice")
+	resp := http.Header{"Cache-Control": {"max-age=60"}}
+	if cache.Storable(r.Header, resp, rt.perUser(r)) {
+		t.Errorf("response for %q stored under %q", r.Header.Get("Cookie"), rt.cacheKey(r))
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// prefetchClientIP stands in for the client address of internal requests in
+// the request log
+const prefetchClientIP = "prefetch"
+
+// Prefetch serves a GET or HEAD issued by the proxy itself, e.g. to warm the
+// cache: it is routed and cached like a client request, but not rate limited
+// or counted in the request totals. A "Cache-Control: no-cache" header forces
+// a fresh entry to be refetched.
+func (rp *ReverseProxy) Prefetch(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return fmt.Errorf("prefetch: method %s not cacheable", r.Method)
+	}
+	table := rp.routes.Load()
+	rt := table.match(r)
+	if rt == nil {
+		return fmt.Errorf("prefetch: no route matches %s", r.URL)
+	}
+	pr := &proxyRequest{table: table, route: rt, clientIP: prefetchClientIP}
+	r = r.WithContext(context.WithValue(r.Context(), requestContextKey, pr))
+	r.URL = rt.rewriteURL(r.URL)
+	rp.handleGetRequest(w, r, pr.clientIP)
+	return nil
+}
+
+// CacheExpiry returns when the cache entry a GET for r would be served from
+// expires, or the zero time if there is none
+func (rp *ReverseProxy) CacheExpiry(r *http.Request) time.Time {
+	rt := rp.routes.Load().match(r)
+	if rt == nil {
+		return time.Time{}
+	}
+	rewritten := r.Clone(r.Context())
+	rewritten.URL = rt.rewriteURL(r.URL)
+	// Peek, so that checking entries for refresh doesn't keep them hot
+	cached := rp.cacheManager.Peek(rt.cacheKey(rewritten), rewritten.Header)
+	if cached == nil {
+		return time.Time{}
+	}
+	return cached.ExpiresAt
+}
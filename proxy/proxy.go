@@ -2,53 +2,97 @@ package proxy
 
 import (
     "bytes"
+    "context"
+    "errors"
     "log"
-    "net"
     "net/http"
+    "net/netip"
     "net/http/httputil"
-    "net/url"
+    "strconv"
     "strings"
+    "sync/atomic"
     "time"
 
     "goproxy/cache"
+    "goproxy/clientip"
+    "goproxy/config"
     "goproxy/metrics"
     "goproxy/ratelimit"
+    "goproxy/upstream"
 )
 
 type ReverseProxy struct {
-	backendURL      string
-    backendParsed   *url.URL
+    routes          atomic.Pointer[routeTable]
 	cacheManager    *cache.Manager
 	rateLimiter     *ratelimit.Manager
 	metricsCollector *metrics.Collector
 	proxy           *httputil.ReverseProxy
+	healthClient    *http.Client
 }
 
-func New(backendURL string, cacheManager *cache.Manager, rateLimiter *ratelimit.Manager, metricsCollector *metrics.Collector) *ReverseProxy {
-	backend, err := url.Parse(backendURL)
-	if err != nil {
-		log.Fatalf("Invalid backend URL: %v", err)
-	}
+type contextKey int
+
+const requestContextKey contextKey = iota
+
+// proxyRequest is per-request state shared between the handler, the Director
+// and the response hooks through the request context
+type proxyRequest struct {
+    table    *routeTable
+    route    *route
+    clientIP string
+    target   *upstream.Target
+    // debugCacheKey is returned in X-Cache-Key when the route asks for it
+    debugCacheKey string
+
+    // Outcome of the upstream attempt, filled in by modifyResponse and
+    // errorHandler
+    attemptStart time.Time
+    latency      time.Duration
+    failed       bool
+    canceled     bool
+    // settled is set once finishAttempt has run for the current attempt
+    settled bool
+}
 
+// outcome classifies the attempt for the circuit breaker
+func (pr *proxyRequest) outcome() upstream.Outcome {
+    switch {
+    case pr.canceled:
+        return upstream.OutcomeIgnored
+    case pr.failed:
+        return upstream.OutcomeFailure
+    default:
+        return upstream.OutcomeSuccess
+    }
+}
+
+func requestFromContext(ctx context.Context) *proxyRequest {
+    return ctx.Value(requestContextKey).(*proxyRequest)
+}
+
+// logHost describes where the request went for the request log: the target
+// that served it, or the upstream name if it never left the proxy
+func (pr *proxyRequest) logHost() (host, scheme string) {
+    if pr.target != nil {
+        return pr.target.URL.Host, pr.target.URL.Scheme
+    }
+    return pr.route.pool.Name, ""
+}
+
+func New(cfg *config.Config, cacheManager *cache.Manager, rateLimiter *ratelimit.Manager, metricsCollector *metrics.Collector) (*ReverseProxy, error) {
     proxy := &ReverseProxy{
-        backendURL:       backendURL,
-        backendParsed:    backend,
         cacheManager:     cacheManager,
         rateLimiter:      rateLimiter,
         metricsCollector: metricsCollector,
     }
-
 	// Create reverse proxy
 	proxy.proxy = &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
+			pr := requestFromContext(req.Context())
+			backend := pr.target.URL
 			req.URL.Scheme = backend.Scheme
 			req.URL.Host = backend.Host
-			req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
-            if req.TLS != nil {
-                req.Header.Set("X-Forwarded-Proto", "https")
-            } else {
-                req.Header.Set("X-Forwarded-Proto", "http")
-            }
+			setForwardedHeaders(req, pr.table.clientIP.TrustedPeer(req))
 			req.Host = backend.Host
 		},
 		ModifyResponse: proxy.modifyResponse,
@@ -65,25 +109,141 @@ func New(backendURL string, cacheManager *cache.Manager, rateLimiter *ratelimit.
         TLSHandshakeTimeout:   10 * time.Second,
         ExpectContinueTimeout: 1 * time.Second,
     }
-    proxy.proxy.Transport = transport
+    proxy.proxy.Transport = &retryTransport{rp: proxy, base: transport}
     proxy.proxy.FlushInterval = 100 * time.Millisecond
+    proxy.healthClient = &http.Client{
+        Transport: transport,
+        // Report redirects as-is instead of probing the redirect target
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+
+	if err := proxy.Reload(cfg); err != nil {
+		return nil, err
+	}
+
+	return proxy, nil
+}
+
+// Reload atomically swaps in the routes and upstreams from cfg for new requests
+func (rp *ReverseProxy) Reload(cfg *config.Config) error {
+    table, err := buildRouteTable(cfg)
+    if err != nil {
+        return err
+    }
+    old := rp.routes.Load()
+    if old != nil {
+        table.inheritHealth(old)
+    }
+    rp.attachBreakers(table, old)
+    rp.startHealthChecks(table)
+    rp.routes.Store(table)
+    if old != nil {
+        old.stopHealthChecks()
+    }
+    return nil
+}
+
+// Close stops background work such as health checks
+func (rp *ReverseProxy) Close() {
+    if table := rp.routes.Load(); table != nil {
+        table.stopHealthChecks()
+    }
+}
+
+// attachBreakers gives each upstream with circuit_breaker configured its
+// breaker, keeping the previous breaker (and its state) if the settings are
+// unchanged across a reload
+func (rp *ReverseProxy) attachBreakers(table *routeTable, old *routeTable) {
+    for name, settings := range table.breakerSettings {
+        name := name // captured by the transition callback
+        pool := table.pools[name]
+        if old != nil {
+            if oldPool, ok := old.pools[name]; ok && oldPool.Breaker != nil && oldPool.Breaker.Settings == settings {
+                pool.Breaker = oldPool.Breaker
+                continue
+            }
+        }
+        pool.Breaker = upstream.NewBreaker(settings, func(from, to upstream.BreakerState) {
+            log.Printf("Circuit breaker for upstream %s: %s -> %s", name, from, to)
+            rp.metricsCollector.RecordBreakerTransition(name, from.String(), to.String(), int(to))
+        })
+        rp.metricsCollector.SetBreakerState(name, int(upstream.BreakerClosed))
+    }
+}
 
-	return proxy
+func (rp *ReverseProxy) startHealthChecks(table *routeTable) {
+    for name, pool := range table.pools {
+        name, pool := name, pool // captured by the health change callback
+        for _, t := range pool.Targets {
+            rp.metricsCollector.SetUpstreamHealth(name, t.String(), t.Healthy())
+        }
+        hc, ok := table.healthChecks[name]
+        if !ok {
+            continue
+        }
+        pool.StartHealthChecks(hc, rp.healthClient, func(t *upstream.Target, healthy bool) {
+            state := "unhealthy, removed from rotation"
+            if healthy {
+                state = "healthy, back in rotation"
+            }
+            log.Printf("Upstream %s target %s is %s", name, t, state)
+            rp.metricsCollector.SetUpstreamHealth(name, t.String(), healthy)
+        })
+    }
+}
+
+// Handler serves requests matching a route and passes everything else to
+// fallback (a 404 when fallback is nil)
+func (rp *ReverseProxy) Handler(fallback http.Handler) http.Handler {
+    if fallback == nil {
+        fallback = http.NotFoundHandler()
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        table := rp.routes.Load()
+        rt := table.match(r)
+        if rt == nil {
+            fallback.ServeHTTP(w, r)
+            return
+        }
+        rp.serveRoute(w, r, table, rt)
+    })
+}
+
+// TrustedProxy reports whether addr is one of the configured trusted proxies
+func (rp *ReverseProxy) TrustedProxy(addr netip.Addr) bool {
+	return rp.routes.Load().clientIP.Trusted(addr)
 }
 
 func (rp *ReverseProxy) HandleRequest(w http.ResponseWriter, r *http.Request) {
+    rp.Handler(nil).ServeHTTP(w, r)
+}
+
+func (rp *ReverseProxy) serveRoute(w http.ResponseWriter, r *http.Request, table *routeTable, rt *route) {
 	start := time.Now()
-	
-	// Extract client IP
-	clientIP := getClientIP(r)
+
+	// Extract client IP, believing forwarding headers only from trusted proxies
+	clientIP := table.clientIP.ClientIP(r)
+
+	// Pin the matched route for the lifetime of this request
+	pr := &proxyRequest{table: table, route: rt, clientIP: clientIP}
+	r = r.WithContext(context.WithValue(r.Context(), requestContextKey, pr))
+	r.URL = rt.rewriteURL(r.URL)
+
+	rp.metricsCollector.RequestStarted()
+	defer rp.metricsCollector.RequestFinished()
 	
 	// Update metrics
 	rp.metricsCollector.IncrementTotalRequests()
 	
 	// Check rate limit
-	if !rp.rateLimiter.Allow(clientIP) {
+	result := rp.rateLimiter.Allow(r, clientIP, rt.name)
+	if !result.Allowed() {
 		rp.metricsCollector.IncrementBlockedRequests()
-		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		setRateLimitHeaders(w.Header(), table.rateLimitHeaders, result)
+		n := table.rateLimitError.write(w, result)
+		host, scheme := pr.logHost()
     rp.metricsCollector.AddRequestLog(metrics.RequestLogEntry{
             Timestamp:  time.Now(),
             Method:     r.Method,
@@ -92,44 +252,45 @@ func (rp *ReverseProxy) HandleRequest(w http.ResponseWriter, r *http.Request) {
             ClientIP:   clientIP,
             DurationMs: float64(time.Since(start).Microseconds()) / 1000.0,
             CacheHit:   false,
-            Bytes:      0,
-        Host:       rp.backendParsed.Host,
-        Scheme:     rp.backendParsed.Scheme,
+            Bytes:      n,
+        Host:       host,
+        Scheme:     scheme,
+        Route:      rt.name,
         UserAgent:  r.UserAgent(),
         Referer:    r.Referer(),
-        ContentType: "",
+        ContentType: w.Header().Get("Content-Type"),
         CacheTTLRemainingMs: 0,
         })
 		return
 	}
+	if table.rateLimitHeaders != "none" {
+		w = &rateLimitWriter{ResponseWriter: w, style: table.rateLimitHeaders, result: result}
+	}
 	
-	// Handle GET requests with caching
-	if r.Method == http.MethodGet {
+	// Handle GET requests with caching; HEAD is answered from GET entries
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
 		rp.handleGetRequest(w, r, clientIP)
 		return
 	}
 	
     // Handle other methods directly with capture for logging
-    capture := &responseCapture{
-        ResponseWriter: w,
-        statusCode:     http.StatusOK,
-        headers:        make(http.Header),
-        body:           &bytes.Buffer{},
-    }
-    rp.proxy.ServeHTTP(capture, r)
+    capture := newResponseCapture(w)
+    rp.forward(capture, r)
     duration := time.Since(start)
+    host, scheme := pr.logHost()
     rp.metricsCollector.RecordResponseTime(duration)
     rp.metricsCollector.AddRequestLog(metrics.RequestLogEntry{
         Timestamp:  time.Now(),
         Method:     r.Method,
         Path:       r.URL.String(),
-        Status:     capture.statusCode,
+        Status:     capture.logStatus(r),
         ClientIP:   clientIP,
         DurationMs: float64(duration.Microseconds()) / 1000.0,
         CacheHit:   false,
-        Bytes:      capture.body.Len(),
-        Host:       rp.backendParsed.Host,
-        Scheme:     rp.backendParsed.Scheme,
+        Bytes:      int(capture.written),
+        Host:       host,
+        Scheme:     scheme,
+        Route:      rt.name,
         UserAgent:  r.UserAgent(),
         Referer:    r.Referer(),
         ContentType: capture.headers.Get("Content-Type"),
@@ -139,81 +300,115 @@ func (rp *ReverseProxy) HandleRequest(w http.ResponseWriter, r *http.Request) {
 
 func (rp *ReverseProxy) handleGetRequest(w http.ResponseWriter, r *http.Request, clientIP string) {
     start := time.Now()
-	// Create cache key
-	cacheKey := r.URL.String()
+    pr := requestFromContext(r.Context())
+    rt := pr.route
+	// Create cache key (scoped per route, since routes may share paths)
+	cacheKey := rt.cacheKey(r)
+	if rt.keyTemplate != nil && rt.keyTemplate.debug {
+		pr.debugCacheKey = cacheKey
+	}
 	
-	// Try to get from cache
-    if cachedResponse := rp.cacheManager.Get(cacheKey); cachedResponse != nil {
+	// Try to get from cache, honoring the client's Cache-Control
+	reqCC := cache.RequestDirectives(r.Header)
+	cached := rp.lookupCache(cacheKey, r)
+	if cached != nil && cached.Satisfies(reqCC, start) {
 		rp.metricsCollector.IncrementCacheHits()
+		if !cached.Fresh(start) {
+			// The client accepted a stale response with max-stale
+			rp.metricsCollector.IncrementCacheStaleServed("max_stale")
+			w.Header().Set("Warning", warningStale)
+		}
 		
 		// Copy cached response to client
-		for key, values := range cachedResponse.Headers {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
-		}
-		w.WriteHeader(cachedResponse.StatusCode)
-        _, _ = w.Write(cachedResponse.Body)
-        duration := time.Since(start)
-        rp.metricsCollector.RecordResponseTime(duration)
-        // compute remaining TTL
-        remaining := time.Until(cachedResponse.ExpiresAt)
-        if remaining < 0 { remaining = 0 }
-        rp.metricsCollector.AddRequestLog(metrics.RequestLogEntry{
-            Timestamp:  time.Now(),
-            Method:     r.Method,
-            Path:       r.URL.String(),
-            Status:     cachedResponse.StatusCode,
-            ClientIP:   clientIP,
-            DurationMs: float64(duration.Microseconds()) / 1000.0,
-            CacheHit:   true,
-            Bytes:      len(cachedResponse.Body),
-            Host:       rp.backendParsed.Host,
-            Scheme:     rp.backendParsed.Scheme,
-            UserAgent:  r.UserAgent(),
-            Referer:    r.Referer(),
-            ContentType: http.Header(cachedResponse.Headers).Get("Content-Type"),
-            CacheTTLRemainingMs: float64(remaining.Microseconds()) / 1000.0,
-        })
+		status, n := rp.writeCached(w, r, cached)
+		rp.logCached(r, start, status, n, cached, true)
+		return
+	}
+
+	// What's left is stale, or not acceptable to the client as is. Within
+	// stale-while-revalidate, answer right away from the stale copy and
+	// refresh it in the background.
+	stale := cached
+	if stale != nil && !reqCC.Has("no-cache") && stale.ServableStale("stale-while-revalidate", pr.table.staleWhileRevalidate, start) {
+		rp.metricsCollector.IncrementCacheHits()
+		rp.metricsCollector.IncrementCacheStaleServed("while_revalidate")
+		rp.refreshInBackground(cacheKey, r, stale)
+		w.Header().Set("Warning", warningStale)
+		status, n := rp.writeCached(w, r, stale)
+		rp.logCached(r, start, status, n, stale, true)
 		return
 	}
 	
 	rp.metricsCollector.IncrementCacheMisses()
-	
-	// Create a custom response writer to capture the response
-	responseWriter := &responseCapture{
-		ResponseWriter: w,
-		statusCode:     http.StatusOK,
-		headers:        make(http.Header),
-        body:           &bytes.Buffer{},
+
+	if reqCC.Has("only-if-cached") {
+		http.Error(w, "Not in cache", http.StatusGatewayTimeout)
+		return
+	}
+
+	// Wait for a fetch of the same URL already in progress instead of sending
+	// another one (requests with credentials can't share responses unless
+	// they are keyed per user, and HEAD and range requests don't fetch the
+	// full response)
+	ranged := r.Header.Get("Range") != ""
+	if timeout := pr.table.coalesceTimeout; timeout > 0 && r.Method == http.MethodGet && !ranged &&
+		(!cache.HasCredentials(r.Header) || rt.perUser(r)) {
+		done, leader := rp.cacheManager.BeginFetch(cacheKey)
+		if leader {
+			defer rp.cacheManager.EndFetch(cacheKey)
+		} else if shared := rp.waitForFetch(r, cacheKey, done, timeout); shared != nil {
+			status, n := rp.writeCached(w, r, shared)
+			rp.logCached(r, start, status, n, shared, true)
+			return
+		}
 	}
 	
-	// Forward request to backend
-	rp.proxy.ServeHTTP(responseWriter, r)
-	
-	// Cache successful GET responses
-	if responseWriter.statusCode == http.StatusOK {
-		cachedResponse := &cache.Response{
-			StatusCode: responseWriter.statusCode,
-			Headers:    responseWriter.headers,
-			Body:       responseWriter.body.Bytes(),
+	// Create a custom response writer to capture the response. Within
+	// stale-if-error, backend errors are held back so the stale copy can be
+	// served instead.
+	responseWriter := newResponseCapture(w)
+	if r.Method == http.MethodHead {
+		// There is no body to cache, so just pass the request through
+		rp.forward(responseWriter, r)
+	} else {
+		responseWriter.holdErrors = stale != nil && stale.ServableStale("stale-if-error", pr.table.staleIfError, start)
+
+		// Forward request to backend
+		refreshed := rp.fetch(responseWriter, r, cacheKey, stale)
+
+		switch {
+		case refreshed != nil:
+			// The backend confirmed the stale copy is still current
+			status, n := rp.writeCached(w, r, refreshed)
+			rp.logCached(r, start, status, n, refreshed, false)
+			return
+		case responseWriter.held:
+			log.Printf("Serving stale %s for route %s after backend status %d", r.URL, rt.name, responseWriter.statusCode)
+			rp.metricsCollector.IncrementCacheStaleServed("if_error")
+			w.Header().Set("Warning", warningRevalidationFailed)
+			status, n := rp.writeCached(w, r, stale)
+			rp.logCached(r, start, status, n, stale, true)
+			return
+		case ranged && responseWriter.statusCode == http.StatusPartialContent:
+			rp.fillAfterRange(cacheKey, r, responseWriter.headers)
 		}
-		rp.cacheManager.Set(cacheKey, cachedResponse)
 	}
 
     duration := time.Since(start)
+    host, scheme := pr.logHost()
     rp.metricsCollector.RecordResponseTime(duration)
     rp.metricsCollector.AddRequestLog(metrics.RequestLogEntry{
         Timestamp:  time.Now(),
         Method:     r.Method,
         Path:       r.URL.String(),
-        Status:     responseWriter.statusCode,
+        Status:     responseWriter.logStatus(r),
         ClientIP:   clientIP,
         DurationMs: float64(duration.Microseconds()) / 1000.0,
         CacheHit:   false,
-        Bytes:      responseWriter.body.Len(),
-        Host:       rp.backendParsed.Host,
-        Scheme:     rp.backendParsed.Scheme,
+        Bytes:      int(responseWriter.written),
+        Host:       host,
+        Scheme:     scheme,
+        Route:      rt.name,
         UserAgent:  r.UserAgent(),
         Referer:    r.Referer(),
         ContentType: responseWriter.headers.Get("Content-Type"),
@@ -221,64 +416,215 @@ func (rp *ReverseProxy) handleGetRequest(w http.ResponseWriter, r *http.Request,
     })
 }
 
+// forward sends the request to a target picked by the route's load balancer
+func (rp *ReverseProxy) forward(w http.ResponseWriter, r *http.Request) {
+    pr := requestFromContext(r.Context())
+    pool := pr.route.pool
+
+    // Fail fast while the upstream's circuit is open
+    breaker := pool.Breaker
+    if breaker != nil && !breaker.Allow() {
+        rp.metricsCollector.IncrementBreakerRejected(pool.Name)
+        body := breaker.Settings.FailBody
+        if body == "" {
+            body = "Backend service unavailable (circuit open)"
+        }
+        http.Error(w, body, breaker.Settings.FailStatus)
+        return
+    }
+
+    target := pool.Pick(r, pr.clientIP)
+    if target == nil {
+        if breaker != nil {
+            breaker.Record(upstream.OutcomeIgnored, 0)
+        }
+        http.Error(w, "No backend available", http.StatusServiceUnavailable)
+        return
+    }
+    rp.startAttempt(pr, target)
+    // Retries may have moved the request to another target by the time
+    // ServeHTTP returns; finishAttempt settles whichever one served it
+    defer func() { rp.finishAttempt(pr, pr.outcome()) }()
+
+    rp.proxy.ServeHTTP(w, r)
+}
+
+// startAttempt points the request at target and starts its accounting. The
+// caller must already have been allowed through the circuit breaker.
+func (rp *ReverseProxy) startAttempt(pr *proxyRequest, target *upstream.Target) {
+    pr.target = target
+    pr.attemptStart = time.Now()
+    pr.latency = 0
+    pr.failed = false
+    pr.canceled = false
+    pr.settled = false
+    pr.route.pool.Acquire(target)
+    rp.metricsCollector.UpstreamRequestStarted(pr.route.pool.Name, target.String())
+}
+
+// finishAttempt settles the accounting for the current attempt, once
+func (rp *ReverseProxy) finishAttempt(pr *proxyRequest, outcome upstream.Outcome) {
+    if pr.settled {
+        return
+    }
+    pr.settled = true
+    pool := pr.route.pool
+    pool.Release(pr.target)
+    rp.metricsCollector.UpstreamRequestFinished(pool.Name, pr.target.String(), outcome == upstream.OutcomeFailure)
+    if pool.Breaker != nil {
+        latency := pr.latency
+        if latency == 0 {
+            latency = time.Since(pr.attemptStart)
+        }
+        pool.Breaker.Record(outcome, latency)
+    }
+}
+
 func (rp *ReverseProxy) modifyResponse(resp *http.Response) error {
+    pr := requestFromContext(resp.Request.Context())
+    pr.latency = time.Since(pr.attemptStart)
+    if resp.StatusCode >= http.StatusInternalServerError {
+        pr.failed = true
+    }
+
 	// Add custom headers
 	resp.Header.Set("X-Proxy-Server", "goproxy")
 	resp.Header.Set("X-Proxy-Timestamp", time.Now().Format(time.RFC3339))
+	if pr.debugCacheKey != "" {
+		resp.Header.Set("X-Cache-Key", pr.debugCacheKey)
+	}
 	return nil
 }
 
 func (rp *ReverseProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
-	log.Printf("Proxy error: %v", err)
+	pr := requestFromContext(r.Context())
+	pr.latency = time.Since(pr.attemptStart)
+	if errors.Is(err, context.Canceled) {
+		// The client went away; that says nothing about the backend
+		pr.canceled = true
+		return
+	}
+	pr.failed = true
+	log.Printf("Proxy error (upstream %s, target %s): %v", pr.route.pool.Name, pr.target, err)
 	http.Error(w, "Backend service unavailable", http.StatusServiceUnavailable)
 }
 
-func getClientIP(r *http.Request) string {
-	// Check for X-Forwarded-For header
-	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		ips := strings.Split(forwardedFor, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
+// setForwardedHeaders tells the backend who sent req. Forwarding headers
+// from a trusted proxy are extended; from anyone else they are replaced, so
+// clients can't spoof them. ReverseProxy appends the peer address to
+// X-Forwarded-For after the Director runs.
+func setForwardedHeaders(req *http.Request, trustedPeer bool) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
 	}
-	
-	// Check for X-Real-IP header
-	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
-		return realIP
+	if !trustedPeer {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Real-IP")
+		req.Header.Del("Forwarded")
 	}
-	
-    // Use remote address (strip port if present)
-    host, _, err := net.SplitHostPort(r.RemoteAddr)
-    if err == nil && host != "" {
-        return host
-    }
-    return r.RemoteAddr
+	if !trustedPeer || req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if !trustedPeer || req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	forwarded := clientip.ForwardedElement(req.RemoteAddr, req.Host, proto)
+	if prior := req.Header.Values("Forwarded"); len(prior) > 0 {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+	req.Header.Set("Forwarded", forwarded)
 }
 
-// responseCapture captures the response for caching
+// responseCapture passes the response through to the client, recording its
+// status, headers and size. The body is only buffered if teeIf says the
+// response may be cached, and is dropped once it grows past teeLimit.
 type responseCapture struct {
 	http.ResponseWriter
 	statusCode int
 	headers    http.Header
-	body       *bytes.Buffer
+	body       *bytes.Buffer // nil unless the body is being teed
+	written    int64
     captured   bool
+
+    teeIf    func(statusCode int, header http.Header) bool
+    teeLimit int64
+
+    // A 304 (the answer to our own revalidation) with holdNotModified set,
+    // or a 5xx with holdErrors set, is held back from the client so it can be
+    // answered from the cache instead; held reports that this happened
+    holdNotModified bool
+    holdErrors      bool
+    held            bool
+}
+
+func newResponseCapture(w http.ResponseWriter) *responseCapture {
+    return &responseCapture{
+        ResponseWriter: w,
+        statusCode:     http.StatusOK,
+        headers:        make(http.Header),
+    }
 }
 
 func (rc *responseCapture) WriteHeader(statusCode int) {
     rc.statusCode = statusCode
+    if rc.holdNotModified && statusCode == http.StatusNotModified ||
+        rc.holdErrors && statusCode >= http.StatusInternalServerError {
+        rc.captureHeaders()
+        // The client gets the cache entry's headers instead
+        for k := range rc.ResponseWriter.Header() {
+            delete(rc.ResponseWriter.Header(), k)
+        }
+        rc.held = true
+        return
+    }
     rc.captureHeaders()
+    if rc.teeIf != nil && rc.teeIf(statusCode, rc.headers) {
+        // Skip bodies already known to be too large
+        length, err := strconv.ParseInt(rc.headers.Get("Content-Length"), 10, 64)
+        if rc.teeLimit <= 0 || err != nil || length <= rc.teeLimit {
+            rc.body = &bytes.Buffer{}
+        }
+    }
     rc.ResponseWriter.WriteHeader(statusCode)
 }
 
 func (rc *responseCapture) Write(data []byte) (int, error) {
+    if rc.held {
+        return len(data), nil
+    }
     if !rc.captured {
         if rc.statusCode == 0 {
             rc.statusCode = http.StatusOK
         }
         rc.captureHeaders()
     }
-    rc.body.Write(data)
-    return rc.ResponseWriter.Write(data)
+    if rc.body != nil {
+        if rc.teeLimit > 0 && int64(rc.body.Len()+len(data)) > rc.teeLimit {
+            // Too large to cache; keep streaming without it
+            rc.body = nil
+        } else {
+            rc.body.Write(data)
+        }
+    }
+    n, err := rc.ResponseWriter.Write(data)
+    rc.written += int64(n)
+    return n, err
+}
+
+// Flush lets the reverse proxy's FlushInterval (and immediate flushing of
+// text/event-stream) reach the client
+func (rc *responseCapture) Flush() {
+    if rc.held {
+        return
+    }
+    http.NewResponseController(rc.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the client's writer to http.ResponseController, e.g. for
+// hijacking the connection on a protocol upgrade
+func (rc *responseCapture) Unwrap() http.ResponseWriter {
+    return rc.ResponseWriter
 }
 
 func (rc *responseCapture) Header() http.Header {
@@ -287,6 +633,19 @@ func (rc *responseCapture) Header() http.Header {
 }
 
 // captureHeaders copies headers from the underlying header map once
+// statusClientClosedRequest is logged, as nginx does, for requests the
+// client canceled before a response started
+const statusClientClosedRequest = 499
+
+// logStatus returns the status to log for r: the one sent, or 499 if the
+// client went away before anything was
+func (rc *responseCapture) logStatus(r *http.Request) int {
+    if !rc.captured && r.Context().Err() != nil {
+        return statusClientClosedRequest
+    }
+    return rc.statusCode
+}
+
 func (rc *responseCapture) captureHeaders() {
     if rc.captured {
         return
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"goproxy/ratelimit"
+)
+
+// seconds rounds d up to whole seconds, as the headers carry them
+func seconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// setRateLimitHeaders reports a result in the IETF RateLimit header fields
+// (draft-ietf-httpapi-ratelimit-headers), in the given style. The quota
+// reported is the tightest one; RateLimit-Policy lists every policy that
+// applied.
+func setRateLimitHeaders(h http.Header, style string, result ratelimit.Result) {
+	d, ok := result.Tightest()
+	if !ok {
+		return
+	}
+	policies := make([]string, 0, len(result.Decisions))
+	switch style {
+	case "none":
+		return
+	case "combined":
+		for _, p := range result.Decisions {
+			policies = append(policies, fmt.Sprintf("%q;q=%d;w=%d", p.Policy, p.Rate.Limit, seconds(p.Rate.Window)))
+		}
+		h.Set("RateLimit-Policy", strings.Join(policies, ", "))
+		h.Set("RateLimit", fmt.Sprintf("%q;r=%d;t=%d", d.Policy, d.Remaining, seconds(d.Reset)))
+	default:
+		for _, p := range result.Decisions {
+			policy := fmt.Sprintf("%d;w=%d", p.Rate.Limit, seconds(p.Rate.Window))
+			if p.Rate.Burst > 0 {
+				policy += ";burst=" + strconv.Itoa(p.Rate.Burst)
+			}
+			policies = append(policies, policy)
+		}
+		h.Set("RateLimit-Limit", strconv.Itoa(d.Rate.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		h.Set("RateLimit-Reset", strconv.FormatInt(seconds(d.Reset), 10))
+		h.Set("RateLimit-Policy", strings.Join(policies, ", "))
+	}
+}
+
+// rateLimitWriter adds the RateLimit headers as the response goes out,
+// after its headers were captured, so they never end up in the cache
+type rateLimitWriter struct {
+	http.ResponseWriter
+	style       string
+	result      ratelimit.Result
+	wroteHeader bool
+}
+
+func (w *rateLimitWriter) WriteHeader(statusCode int) {
+	setRateLimitHeaders(w.ResponseWriter.Header(), w.style, w.result)
+	if statusCode >= http.StatusOK {
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *rateLimitWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *rateLimitWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the client's writer to http.ResponseController
+func (w *rateLimitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// rateLimitError renders the body of 429 responses
+type rateLimitError struct {
+	// format is text, json or html; body, if set, replaces the built-in one
+	format string
+	body   string
+}
+
+// write sends a 429 for a denied result, reporting the denial that lasts
+// longest
+func (e rateLimitError) write(w http.ResponseWriter, result ratelimit.Result) int {
+	d, _ := result.Tightest()
+	retryAfter := seconds(d.RetryAfter)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	values := map[string]string{
+		"policy":      d.Policy,
+		"limit":       strconv.Itoa(d.Rate.Limit),
+		"remaining":   strconv.Itoa(d.Remaining),
+		"reset":       strconv.FormatInt(seconds(d.Reset), 10),
+		"retry_after": strconv.FormatInt(retryAfter, 10),
+	}
+
+	var contentType, body string
+	switch e.format {
+	case "json":
+		contentType = "application/json"
+		b, _ := json.Marshal(map[string]interface{}{
+			"error":       "rate_limit_exceeded",
+			"message":     "Rate limit exceeded",
+			"policy":      d.Policy,
+			"limit":       d.Rate.Limit,
+			"remaining":   d.Remaining,
+			"reset":       seconds(d.Reset),
+			"retry_after": retryAfter,
+		})
+		body = string(b) + "\n"
+	case "html":
+		contentType = "text/html; charset=utf-8"
+		body = fmt.Sprintf("<!DOCTYPE html>\n<html><head><title>429 Too Many Requests</title></head>\n"+
+			"<body><h1>Too Many Requests</h1><p>Rate limit exceeded. Please try again in %s seconds.</p></body></html>\n",
+			html.EscapeString(values["retry_after"]))
+	default:
+		contentType = "text/plain; charset=utf-8"
+		body = "Rate limit exceeded\n"
+	}
+	if e.body != "" {
+		replacements := make([]string, 0, 2*len(values))
+		for name, value := range values {
+			replacements = append(replacements, "{"+name+"}", value)
+		}
+		body = strings.NewReplacer(replacements...).Replace(e.body)
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Retry-After", values["retry_after"])
+	w.WriteHeader(http.StatusTooManyRequests)
+	n, _ := w.Write([]byte(body))
+	return n
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"goproxy/upstream"
+)
+
+// retryPolicy is a compiled config.RetryConfig for one route
+type retryPolicy struct {
+	maxAttempts        int
+	retryOnStatus      map[int]bool
+	retryNonIdempotent bool
+	backoffBase        time.Duration
+	backoffMax         time.Duration
+	maxBodyBytes       int64
+}
+
+func (p *retryPolicy) allowsMethod(method string) bool {
+	if p.retryNonIdempotent {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before retry number n (1-based): exponential
+// growth capped at backoffMax, with full jitter so retries from many clients
+// don't line up
+func (p *retryPolicy) backoff(n int) time.Duration {
+	d := p.backoffBase
+	for i := 1; i < n && d < p.backoffMax; i++ {
+		d *= 2
+	}
+	if d > p.backoffMax {
+		d = p.backoffMax
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryBudget caps retries to a fraction of recent requests so that retries
+// can't multiply load on an upstream that is already struggling. A small
+// floor of retries per second is always allowed so quiet routes can retry.
+type retryBudget struct {
+	ratio     float64
+	minPerSec float64
+	window    time.Duration
+
+	mu      sync.Mutex
+	buckets []budgetBucket
+}
+
+type budgetBucket struct {
+	second   int64
+	requests int64
+	retries  int64
+}
+
+func newRetryBudget(ratio, minPerSec float64, window time.Duration) *retryBudget {
+	if window < time.Second {
+		window = time.Second
+	}
+	return &retryBudget{
+		ratio:     ratio,
+		minPerSec: minPerSec,
+		window:    window,
+		buckets:   make([]budgetBucket, int(window/time.Second)),
+	}
+}
+
+func (b *retryBudget) bucketLocked(now time.Time) *budgetBucket {
+	sec := now.Unix()
+	bucket := &b.buckets[sec%int64(len(b.buckets))]
+	if bucket.second != sec {
+		*bucket = budgetBucket{second: sec}
+	}
+	return bucket
+}
+
+// recordRequest counts an original (non-retry) request
+func (b *retryBudget) recordRequest() {
+	b.mu.Lock()
+	b.bucketLocked(time.Now()).requests++
+	b.mu.Unlock()
+}
+
+// tryRetry reserves budget for one retry, reporting false if exhausted
+func (b *retryBudget) tryRetry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	oldest := now.Unix() - int64(len(b.buckets)) + 1
+	var requests, retries int64
+	for _, bucket := range b.buckets {
+		if bucket.second >= oldest {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	allowed := b.minPerSec*b.window.Seconds() + b.ratio*float64(requests)
+	if float64(retries) >= allowed {
+		return false
+	}
+	b.bucketLocked(now).retries++
+	return true
+}
+
+// retryTransport retries failed upstream attempts on another target of the
+// same pool. The final attempt is accounted for by forward and the
+// ReverseProxy hooks as usual; failed intermediate attempts are accounted for
+// here.
+type retryTransport struct {
+	rp   *ReverseProxy
+	base http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pr := requestFromContext(req.Context())
+	policy := pr.route.retry
+	budget := pr.table.retryBudget
+	budget.recordRequest()
+	if policy == nil || policy.maxAttempts <= 1 || !policy.allowsMethod(req.Method) {
+		return t.base.RoundTrip(req)
+	}
+
+	replayable, err := bufferBody(req, policy.maxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	tried := map[*upstream.Target]bool{pr.target: true}
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+
+		retryable := false
+		switch {
+		case err != nil:
+			retryable = !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+		case policy.retryOnStatus[resp.StatusCode]:
+			retryable = true
+		}
+		if !retryable || !replayable || attempt >= policy.maxAttempts {
+			return resp, err
+		}
+		// Pick the target first, so budget is only spent on retries that
+		// happen
+		next, ok := t.rp.retryTarget(pr, req, tried)
+		if !ok {
+			return resp, err
+		}
+		if !budget.tryRetry() {
+			// Give back the attempt the breaker allowed
+			if pr.route.pool.Breaker != nil {
+				pr.route.pool.Breaker.Record(upstream.OutcomeIgnored, 0)
+			}
+			t.rp.metricsCollector.IncrementRetryBudgetExhausted(pr.route.name)
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		// Settle the failed attempt before backing off, so the sleep isn't
+		// counted as its latency or held against its target
+		t.rp.finishAttempt(pr, upstream.OutcomeFailure)
+
+		select {
+		case <-time.After(policy.backoff(attempt)):
+		case <-req.Context().Done():
+			// Give back the attempt the breaker allowed for next
+			if pr.route.pool.Breaker != nil {
+				pr.route.pool.Breaker.Record(upstream.OutcomeIgnored, 0)
+			}
+			return nil, req.Context().Err()
+		}
+
+		t.rp.metricsCollector.IncrementRetries(pr.route.name)
+		tried[next] = true
+		t.rp.startAttempt(pr, next)
+		req = retryRequest(req, next)
+	}
+}
+
+// retryTarget picks the target for another attempt, preferring targets not
+// tried yet. It reports false if the circuit breaker won't allow another
+// attempt, e.g. while half-open.
+func (rp *ReverseProxy) retryTarget(pr *proxyRequest, req *http.Request, tried map[*upstream.Target]bool) (*upstream.Target, bool) {
+	pool := pr.route.pool
+	if pool.Breaker != nil && !pool.Breaker.Allow() {
+		return nil, false
+	}
+	next := pool.PickExcluding(req, pr.clientIP, tried)
+	if next == nil {
+		next = pr.target
+	}
+	return next, true
+}
+
+// retryRequest clones req for another attempt against target
+func retryRequest(req *http.Request, target *upstream.Target) *http.Request {
+	next := req.Clone(req.Context())
+	next.URL.Scheme = target.URL.Scheme
+	next.URL.Host = target.URL.Host
+	next.Host = target.URL.Host
+	if req.GetBody != nil {
+		next.Body, _ = req.GetBody()
+	}
+	return next
+}
+
+// bufferBody reads the request body into memory so it can be replayed. It
+// reports false, leaving the body intact for a single attempt, if the body is
+// larger than limit.
+func bufferBody(req *http.Request, limit int64) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+	if req.ContentLength > limit {
+		return false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(buf)) > limit {
+		// Too large to replay: stitch the consumed prefix back on
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return false, nil
+	}
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
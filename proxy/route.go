@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"goproxy/clientip"
+	"goproxy/config"
+	"goproxy/upstream"
+)
+
+// route is a compiled config.RouteConfig
+type route struct {
+	name          string
+	host          string
+	pathPrefix    string
+	pathRegex     *regexp.Regexp
+	methods       map[string]bool
+	headers       map[string]string
+	pool          *upstream.Pool
+	stripPrefix   string
+	rewritePrefix string
+	retry         *retryPolicy
+	keyTemplate   *cacheKeyTemplate
+	statusTTL     statusTTLs
+}
+
+// statusTTLs maps status codes, and classes such as 5xx keyed by their first
+// digit, to the default lifetime of responses with that status
+type statusTTLs map[int]time.Duration
+
+// newStatusTTLs merges route rules over the cache-wide ones. Patterns were
+// checked by config.Validate.
+func newStatusTTLs(rulesets ...map[string]config.Duration) statusTTLs {
+	ttls := make(statusTTLs)
+	for _, rules := range rulesets {
+		for pattern, ttl := range rules {
+			if code, err := config.ParseStatusPattern(pattern); err == nil {
+				ttls[code] = ttl.Duration
+			}
+		}
+	}
+	return ttls
+}
+
+// lifetime returns how long a response with status code stays fresh when
+// the backend gives no lifetime, and whether it may be cached at all. An
+// exact code beats its class; 200 falls back to def.
+func (s statusTTLs) lifetime(code int, def time.Duration) (time.Duration, bool) {
+	if code == http.StatusPartialContent || code == http.StatusNotModified {
+		return 0, false
+	}
+	if ttl, ok := s[code]; ok {
+		return ttl, ttl > 0
+	}
+	if ttl, ok := s[code/100]; ok {
+		return ttl, ttl > 0
+	}
+	return def, code == http.StatusOK
+}
+
+// routeTable is the swappable part of the proxy configuration. Each request
+// pins the table it started with, so a reload never affects in-flight requests.
+type routeTable struct {
+	routes       []*route
+	pools        map[string]*upstream.Pool
+	healthChecks map[string]upstream.HealthCheck
+	// breakerSettings is applied by ReverseProxy.attachBreakers, which also
+	// wires up logging and metrics
+	breakerSettings map[string]upstream.BreakerSettings
+	retryBudget     *retryBudget
+	// Default stale serving windows, see config.CacheConfig
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	coalesceTimeout      time.Duration
+	// maxObjectBytes caps how much of a response body is buffered for the
+	// cache (0 means unlimited)
+	maxObjectBytes int64
+	// How quotas are reported to clients, see config.RateLimitConfig
+	rateLimitHeaders string
+	rateLimitError   rateLimitError
+	clientIP         *clientip.Resolver
+}
+
+func buildRouteTable(cfg *config.Config) (*routeTable, error) {
+	pools := make(map[string]*upstream.Pool)
+	healthChecks := make(map[string]upstream.HealthCheck)
+	breakerSettings := make(map[string]upstream.BreakerSettings)
+	for _, uc := range cfg.UpstreamList() {
+		var targets []*upstream.Target
+		for _, tc := range uc.TargetList() {
+			target, err := url.Parse(tc.URL)
+			if err != nil {
+				return nil, fmt.Errorf("upstream %q: %v", uc.Name, err)
+			}
+			if target.Scheme == "" || target.Host == "" {
+				return nil, fmt.Errorf("upstream %q: URL %q must include scheme and host", uc.Name, tc.URL)
+			}
+			targets = append(targets, upstream.NewTarget(target, tc.TargetWeight()))
+		}
+		pool, err := upstream.NewPool(uc.Name, targets, uc.LoadBalancer, uc.HashKey)
+		if err != nil {
+			return nil, err
+		}
+		pools[uc.Name] = pool
+
+		if hc := cfg.HealthCheckFor(uc); !hc.Disabled {
+			healthChecks[uc.Name] = upstream.HealthCheck{
+				Path:               hc.Path,
+				Interval:           hc.Interval.Duration,
+				Timeout:            hc.Timeout.Duration,
+				ExpectedStatus:     hc.ExpectedStatus,
+				ExpectedBody:       hc.ExpectedBody,
+				HealthyThreshold:   hc.HealthyThreshold,
+				UnhealthyThreshold: hc.UnhealthyThreshold,
+			}
+		}
+
+		if cb := uc.CircuitBreaker; cb != nil {
+			settings := upstream.BreakerSettings{
+				ConsecutiveFailures: cb.ConsecutiveFailures,
+				LatencyThreshold:    cb.LatencyThreshold.Duration,
+				OpenDuration:        cb.OpenDuration.Duration,
+				HalfOpenRequests:    cb.HalfOpenRequests,
+				FailStatus:          cb.FailStatus,
+				FailBody:            cb.FailBody,
+			}
+			// Apply defaults now so settings compare equal across reloads
+			breakerSettings[uc.Name] = settings.WithDefaults()
+		}
+	}
+
+	resolver, err := clientip.New(cfg.ClientIP.TrustedProxies, cfg.ClientIP.Headers)
+	if err != nil {
+		return nil, err
+	}
+	table := &routeTable{
+		pools:           pools,
+		healthChecks:    healthChecks,
+		breakerSettings: breakerSettings,
+		retryBudget:     newRetryBudget(cfg.RetryBudget.Ratio, cfg.RetryBudget.MinRetriesPerSecond, cfg.RetryBudget.Window.Duration),
+
+		staleWhileRevalidate: cfg.Cache.StaleWhileRevalidate.Duration,
+		staleIfError:         cfg.Cache.StaleIfError.Duration,
+		coalesceTimeout:      cfg.Cache.CoalesceTimeout.Duration,
+		maxObjectBytes:       cfg.Cache.ObjectLimit(),
+
+		rateLimitHeaders: cfg.RateLimit.Headers,
+		rateLimitError:   rateLimitError{format: cfg.RateLimit.ErrorFormat, body: cfg.RateLimit.ErrorBody},
+		clientIP:         resolver,
+	}
+	for _, rc := range cfg.RouteList() {
+		pool, ok := pools[rc.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("route %q: unknown upstream %q", rc.Name, rc.Upstream)
+		}
+		rt := &route{
+			name:          rc.Name,
+			host:          strings.ToLower(rc.Host),
+			pathPrefix:    rc.PathPrefix,
+			headers:       rc.Headers,
+			pool:          pool,
+			stripPrefix:   rc.StripPrefix,
+			rewritePrefix: rc.RewritePrefix,
+			statusTTL:     newStatusTTLs(cfg.Cache.StatusTTL, rc.StatusTTL),
+		}
+		if rc.PathRegex != "" {
+			re, err := regexp.Compile(rc.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: path_regex: %v", rc.Name, err)
+			}
+			rt.pathRegex = re
+		}
+		if rc.Retry != nil {
+			rt.retry = newRetryPolicy(rc.Retry)
+		}
+		if rc.CacheKey != nil {
+			rt.keyTemplate = newCacheKeyTemplate(rc.CacheKey)
+		}
+		if len(rc.Methods) > 0 {
+			rt.methods = make(map[string]bool, len(rc.Methods))
+			for _, m := range rc.Methods {
+				rt.methods[strings.ToUpper(m)] = true
+			}
+		}
+		table.routes = append(table.routes, rt)
+	}
+	return table, nil
+}
+
+func newRetryPolicy(rc *config.RetryConfig) *retryPolicy {
+	policy := &retryPolicy{
+		maxAttempts:        rc.MaxAttempts,
+		retryOnStatus:      make(map[int]bool),
+		retryNonIdempotent: rc.RetryNonIdempotent,
+		backoffBase:        rc.BackoffBase.Duration,
+		backoffMax:         rc.BackoffMax.Duration,
+		maxBodyBytes:       rc.MaxBodyBytes,
+	}
+	if policy.maxAttempts == 0 {
+		policy.maxAttempts = 3
+	}
+	statuses := rc.RetryOnStatus
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	for _, code := range statuses {
+		policy.retryOnStatus[code] = true
+	}
+	if policy.backoffBase == 0 {
+		policy.backoffBase = 25 * time.Millisecond
+	}
+	if policy.backoffMax == 0 {
+		policy.backoffMax = time.Second
+	}
+	if policy.maxBodyBytes == 0 {
+		policy.maxBodyBytes = 64 << 10
+	}
+	return policy
+}
+
+// inheritHealth copies target health from the previous table so a reload
+// doesn't put known-bad targets back into rotation
+func (t *routeTable) inheritHealth(prev *routeTable) {
+	for name, pool := range t.pools {
+		old, ok := prev.pools[name]
+		if !ok {
+			continue
+		}
+		for _, target := range pool.Targets {
+			if oldTarget := old.Target(target.String()); oldTarget != nil {
+				target.SetHealthy(oldTarget.Healthy())
+			}
+		}
+	}
+}
+
+func (t *routeTable) stopHealthChecks() {
+	for _, pool := range t.pools {
+		pool.StopHealthChecks()
+	}
+}
+
+// match returns the first route that matches r, or nil
+func (t *routeTable) match(r *http.Request) *route {
+	for _, rt := range t.routes {
+		if rt.matches(r) {
+			return rt
+		}
+	}
+	return nil
+}
+
+func (rt *route) matches(r *http.Request) bool {
+	if rt.host != "" && !matchHost(rt.host, r.Host) {
+		return false
+	}
+	if rt.pathPrefix != "" && !strings.HasPrefix(r.URL.Path, rt.pathPrefix) {
+		return false
+	}
+	if rt.pathRegex != nil && !rt.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if rt.methods != nil && !rt.methods[r.Method] {
+		return false
+	}
+	for name, want := range rt.headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return false
+		}
+		if want != "" && !containsValue(values, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+func containsValue(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteURL applies the route's strip and rewrite prefixes to a copy of u
+func (rt *route) rewriteURL(u *url.URL) *url.URL {
+	if rt.stripPrefix == "" && rt.rewritePrefix == "" {
+		return u
+	}
+	rewritten := *u
+	rewritten.Path = rt.rewritePath(u.Path)
+	if u.RawPath != "" {
+		rewritten.RawPath = rt.rewritePath(u.RawPath)
+	}
+	return &rewritten
+}
+
+func (rt *route) rewritePath(p string) string {
+	p = strings.TrimPrefix(p, rt.stripPrefix)
+	if strings.HasSuffix(rt.rewritePrefix, "/") && strings.HasPrefix(p, "/") {
+		p = p[1:]
+	}
+	p = rt.rewritePrefix + p
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
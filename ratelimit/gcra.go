@@ -0,0 +1,55 @@
+package ratelimit
+
+import "time"
+
+// gcra implements the generic cell rate algorithm. Each key stores only its
+// theoretical arrival time (TAT): when the next request would be due if
+// requests had arrived at exactly the rate. A request is allowed unless the
+// TAT is further ahead of now than the burst tolerates.
+type gcra struct {
+	currentRate
+	tats *shardedState[int64]
+}
+
+func newGCRA(rate Rate) *gcra {
+	l := &gcra{tats: newShardedState[int64]()}
+	l.SetRate(rate)
+	return l
+}
+
+func (l *gcra) Allow(key string, now time.Time) Decision {
+	rate := l.load()
+	interval := int64(rate.interval())
+	// A full burst may be sent at once, so the TAT may run up to burst
+	// intervals ahead
+	tolerance := interval * int64(rate.burst())
+	ns := now.UnixNano()
+	sh := l.tats.lock(key)
+	defer sh.mu.Unlock()
+	tat, found := sh.states[key]
+	if !found || tat < ns {
+		tat = ns
+	}
+	if tat+interval-ns > tolerance {
+		return Decision{
+			Rate:       rate,
+			Reset:      time.Duration(tat - ns),
+			RetryAfter: time.Duration(tat + interval - ns - tolerance),
+		}
+	}
+	tat += interval
+	sh.states[key] = tat
+	return Decision{
+		Allowed:   true,
+		Rate:      rate,
+		Remaining: int((tolerance - (tat - ns)) / interval),
+		Reset:     time.Duration(tat - ns),
+	}
+}
+
+func (l *gcra) Sweep(now time.Time) int {
+	ns := now.UnixNano()
+	return l.tats.sweep(func(tat int64) bool { return tat <= ns })
+}
+
+func (l *gcra) Len() int { return l.tats.len() }
@@ -0,0 +1,225 @@
+package ratelimit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultPolicy names the per-IP policy used when none are configured
+const DefaultPolicy = "default"
+
+// PolicySpec describes a limit applied to requests that share a key
+type PolicySpec struct {
+	Name string
+	// Key lists what the key is built from, see parseKeyPart; several parts
+	// make a composite key
+	Key []string
+	// Routes limits the policy to the named routes; empty means all
+	Routes    []string
+	Algorithm string
+	Rate      Rate
+}
+
+// keyPart extracts one component of a policy key from a request
+type keyPart struct {
+	kind string // ip, route, header, query, cookie or jwt
+	name string
+}
+
+// parseKeyPart parses a key part: "ip", "route", "header:X-API-Key",
+// "query:api_key", "cookie:session" or "jwt:sub" (a claim of the bearer
+// token in Authorization)
+func parseKeyPart(s string) (keyPart, error) {
+	kind, name, _ := strings.Cut(strings.TrimSpace(s), ":")
+	kind = strings.ToLower(kind)
+	switch kind {
+	case "ip", "route":
+		if name == "" {
+			return keyPart{kind: kind}, nil
+		}
+	case "header", "query", "cookie", "jwt":
+		if name != "" {
+			return keyPart{kind: kind, name: name}, nil
+		}
+		return keyPart{}, fmt.Errorf("key part %q needs a name, e.g. %s:name", s, kind)
+	}
+	return keyPart{}, fmt.Errorf("unknown key part %q (want ip, route, header:, query:, cookie: or jwt:)", s)
+}
+
+// value returns the part's value for r, or false if r doesn't have one
+func (p keyPart) value(r *http.Request, clientIP, route string) (string, bool) {
+	var v string
+	switch p.kind {
+	case "ip":
+		v = clientIP
+	case "route":
+		v = route
+	case "header":
+		v = r.Header.Get(p.name)
+	case "query":
+		v = r.URL.Query().Get(p.name)
+	case "cookie":
+		if c, err := r.Cookie(p.name); err == nil {
+			v = c.Value
+		}
+	case "jwt":
+		v = jwtClaim(r.Header.Get("Authorization"), p.name)
+	}
+	return v, v != ""
+}
+
+// jwtClaim returns a claim from the payload of a bearer JWT as a string.
+// The signature is not checked, so clients can choose the value; stack
+// such policies with a per-IP one.
+func jwtClaim(authorization, claim string) string {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// policy is a compiled PolicySpec with its limiter
+type policy struct {
+	name      string
+	key       []keyPart
+	routes    map[string]bool
+	algorithm string
+	limiter   Limiter
+}
+
+// keyFor builds r's key, or reports false if a part is missing and the policy
+// doesn't apply
+func (p *policy) keyFor(r *http.Request, clientIP, route string) (string, bool) {
+	if len(p.routes) > 0 && !p.routes[route] {
+		return "", false
+	}
+	if len(p.key) == 1 {
+		return p.key[0].value(r, clientIP, route)
+	}
+	var b strings.Builder
+	for i, part := range p.key {
+		v, ok := part.value(r, clientIP, route)
+		if !ok {
+			return "", false
+		}
+		if i > 0 {
+			b.WriteByte(0)
+		}
+		b.WriteString(v)
+	}
+	return b.String(), true
+}
+
+// Result holds the decisions of every policy that applied to a request
+type Result struct {
+	Decisions []Decision
+}
+
+// Allowed reports whether every policy allowed the request
+func (r Result) Allowed() bool {
+	for _, d := range r.Decisions {
+		if !d.Allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// Tightest returns the decision to report to the client: the denial that
+// lasts longest, or else the policy with the fewest requests remaining
+func (r Result) Tightest() (Decision, bool) {
+	if len(r.Decisions) == 0 {
+		return Decision{}, false
+	}
+	tightest := r.Decisions[0]
+	for _, d := range r.Decisions[1:] {
+		switch {
+		case !d.Allowed && tightest.Allowed:
+			tightest = d
+		case !d.Allowed && d.RetryAfter > tightest.RetryAfter:
+			tightest = d
+		case d.Allowed && tightest.Allowed && d.Remaining < tightest.Remaining:
+			tightest = d
+		}
+	}
+	return tightest, true
+}
+
+// compilePolicies builds the policies for specs, keeping the limiter (and so
+// the counts) of a policy in old with the same name and algorithm
+func compilePolicies(specs []PolicySpec, old []*policy, newLimiter func(PolicySpec) (Limiter, error)) ([]*policy, error) {
+	existing := make(map[string]*policy, len(old))
+	for _, p := range old {
+		existing[p.name] = p
+	}
+	policies := make([]*policy, 0, len(specs))
+	for _, spec := range specs {
+		p := &policy{name: spec.Name, algorithm: spec.Algorithm}
+		if len(spec.Key) == 0 {
+			return nil, fmt.Errorf("rate limit policy %q: key is required", spec.Name)
+		}
+		for _, s := range spec.Key {
+			part, err := parseKeyPart(s)
+			if err != nil {
+				return nil, fmt.Errorf("rate limit policy %q: %v", spec.Name, err)
+			}
+			p.key = append(p.key, part)
+		}
+		if len(spec.Routes) > 0 {
+			p.routes = make(map[string]bool, len(spec.Routes))
+			for _, route := range spec.Routes {
+				p.routes[route] = true
+			}
+		}
+		if prev, ok := existing[spec.Name]; ok && prev.algorithm == spec.Algorithm {
+			p.limiter = prev.limiter
+			p.limiter.SetRate(spec.Rate)
+		} else {
+			limiter, err := newLimiter(spec)
+			if err != nil {
+				return nil, fmt.Errorf("rate limit policy %q: %v", spec.Name, err)
+			}
+			p.limiter = limiter
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// check runs r past every policy that applies to it
+func check(policies []*policy, r *http.Request, clientIP, route string, now time.Time) Result {
+	var result Result
+	for _, p := range policies {
+		key, ok := p.keyFor(r, clientIP, route)
+		if !ok {
+			continue
+		}
+		d := p.limiter.Allow(key, now)
+		d.Policy = p.name
+		result.Decisions = append(result.Decisions, d)
+	}
+	return result
+}
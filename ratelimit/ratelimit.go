@@ -1,151 +1,224 @@
 package ratelimit
 
 import (
-	"sync"
+	"fmt"
+	"net/http"
+	"sync/atomic"
 	"time"
 )
 
-type Request struct {
-	Timestamp time.Time
+// Rate is a limit of Limit requests per Window. Burst is how many requests
+// may arrive at once; 0 means Limit.
+type Rate struct {
+	Limit  int
+	Window time.Duration
+	Burst  int
 }
 
-type IPLimiter struct {
-	requests []Request
-	limit    int
-	window   time.Duration
-	mutex    sync.RWMutex
+// PerMinute returns a rate of requestsPerMinute with the given burst
+func PerMinute(requestsPerMinute, burst int) Rate {
+	return Rate{Limit: requestsPerMinute, Window: time.Minute, Burst: burst}
 }
 
+func (r Rate) burst() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Limit
+}
+
+// interval is the time between requests at a steady rate
+func (r Rate) interval() time.Duration {
+	if r.Limit <= 0 {
+		return r.Window
+	}
+	if d := r.Window / time.Duration(r.Limit); d > 0 {
+		return d
+	}
+	return 1
+}
+
+// perNanosecond is the steady rate in requests per nanosecond
+func (r Rate) perNanosecond() float64 {
+	return float64(r.Limit) / float64(r.Window)
+}
+
+// Decision is the result of checking one request against a rate
+type Decision struct {
+	// Policy names the policy that decided, when checked by a Manager
+	Policy  string
+	Allowed bool
+	// Rate is the rate checked against. Burst is 0 for algorithms that
+	// don't use it.
+	Rate      Rate
+	Remaining int
+	// Reset is how long until the key has its full allowance again
+	Reset time.Duration
+	// RetryAfter is how long until a request would be allowed, if this one
+	// wasn't
+	RetryAfter time.Duration
+}
+
+// Limiter tracks a rate per key in constant memory per key. Implementations
+// are safe for concurrent use.
+type Limiter interface {
+	// Allow decides whether a request for key at now is within the rate,
+	// and counts it if so
+	Allow(key string, now time.Time) Decision
+	// SetRate changes the rate for new and existing keys
+	SetRate(rate Rate)
+	// Sweep drops keys that are back to their full allowance at now, since
+	// forgetting them changes nothing, and returns how many it dropped
+	Sweep(now time.Time) int
+	// Len returns the number of keys tracked
+	Len() int
+}
+
+// Algorithm names accepted by NewLimiter
+const (
+	AlgorithmTokenBucket   = "token_bucket"
+	AlgorithmGCRA          = "gcra"
+	AlgorithmSlidingWindow = "sliding_window"
+)
+
+// NewLimiter returns a limiter using the named algorithm:
+//   - token_bucket (default): a bucket of Burst tokens refilled at the rate
+//   - gcra: the generic cell rate algorithm, which behaves like a token
+//     bucket but stores a single timestamp per key
+//   - sliding_window: counts in the current and previous fixed windows,
+//     weighted by their overlap with the sliding window; Burst is unused
+func NewLimiter(algorithm string, rate Rate) (Limiter, error) {
+	switch algorithm {
+	case "", AlgorithmTokenBucket:
+		return newTokenBucket(rate), nil
+	case AlgorithmGCRA:
+		return newGCRA(rate), nil
+	case AlgorithmSlidingWindow:
+		return newSlidingWindow(rate), nil
+	}
+	return nil, fmt.Errorf("unknown rate limit algorithm %q (want %s, %s or %s)", algorithm, AlgorithmTokenBucket, AlgorithmGCRA, AlgorithmSlidingWindow)
+}
+
+// Manager applies a set of rate limit policies to requests
 type Manager struct {
-	limiters sync.Map
-	limit    int
-	window   time.Duration
-	stopChan chan struct{}
+	policies        atomic.Pointer[[]*policy]
+	shared          *storeGuard
+	cleanupInterval time.Duration
+	stopChan        chan struct{}
 }
 
-func New(requestsPerMinute int) *Manager {
+// New creates a rate limiter enforcing specs. cleanupInterval controls how
+// often state for inactive keys is dropped. If shared is set, the counts are
+// kept in its store, and the Manager closes the store.
+func New(specs []PolicySpec, cleanupInterval time.Duration, shared *Shared) (*Manager, error) {
+	if cleanupInterval <= 0 {
+		cleanupInterval = 5 * time.Minute
+	}
 	manager := &Manager{
-		limit:    requestsPerMinute,
-		window:   time.Minute,
-		stopChan: make(chan struct{}),
+		cleanupInterval: cleanupInterval,
+		stopChan:        make(chan struct{}),
+	}
+	if shared != nil {
+		manager.shared = &storeGuard{Shared: *shared}
+		if manager.shared.Timeout <= 0 {
+			manager.shared.Timeout = 100 * time.Millisecond
+		}
+		if manager.shared.SyncInterval <= 0 {
+			manager.shared.SyncInterval = 500 * time.Millisecond
+		}
+		if manager.shared.RetryInterval <= 0 {
+			manager.shared.RetryInterval = 5 * time.Second
+		}
+	}
+	if err := manager.SetPolicies(specs); err != nil {
+		return nil, err
 	}
-	
+
 	// Start cleanup goroutine
 	go manager.cleanup()
-	
-	return manager
+	if manager.shared != nil && manager.shared.Approximate {
+		go manager.sync()
+	}
+
+	return manager, nil
 }
 
-func (m *Manager) Allow(ip string) bool {
-	limiter := m.getOrCreateLimiter(ip)
-	return limiter.Allow()
+// Allow checks a request from clientIP on route against every policy that
+// applies to it. Policies whose key the request lacks don't apply.
+func (m *Manager) Allow(r *http.Request, clientIP, route string) Result {
+	return check(*m.policies.Load(), r, clientIP, route, time.Now())
+}
+
+// SetPolicies replaces the policies. Policies that keep their name and
+// algorithm keep their counts.
+func (m *Manager) SetPolicies(specs []PolicySpec) error {
+	var old []*policy
+	if current := m.policies.Load(); current != nil {
+		old = *current
+	}
+	policies, err := compilePolicies(specs, old, m.newLimiter)
+	if err != nil {
+		return err
+	}
+	m.policies.Store(&policies)
+	return nil
 }
 
-func (m *Manager) getOrCreateLimiter(ip string) *IPLimiter {
-	// Try to get existing limiter
-	if value, ok := m.limiters.Load(ip); ok {
-		return value.(*IPLimiter)
+// newLimiter creates the limiter for a policy, counting in the store if
+// there is one
+func (m *Manager) newLimiter(spec PolicySpec) (Limiter, error) {
+	local, err := NewLimiter(spec.Algorithm, spec.Rate)
+	if err != nil || m.shared == nil {
+		return local, err
 	}
-	
-	// Create new limiter
-	limiter := &IPLimiter{
-		requests: make([]Request, 0),
-		limit:    m.limit,
-		window:   m.window,
+	if m.shared.Approximate {
+		if spec.Algorithm != AlgorithmSlidingWindow {
+			return nil, fmt.Errorf("approximate shared counting needs the %s algorithm, got %q", AlgorithmSlidingWindow, spec.Algorithm)
+		}
+		return newApproxLimiter(m.shared, spec.Name, spec.Rate), nil
 	}
-	
-	// Store the limiter
-	m.limiters.Store(ip, limiter)
-	
-	return limiter
+	return newSharedLimiter(m.shared, spec.Name, spec.Algorithm, local, spec.Rate), nil
 }
 
 func (m *Manager) cleanup() {
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := time.NewTicker(m.cleanupInterval)
 	defer ticker.Stop()
-	
+
 	for {
 		select {
 		case <-ticker.C:
-			m.removeInactiveLimiters()
+			now := time.Now()
+			for _, p := range *m.policies.Load() {
+				p.limiter.Sweep(now)
+			}
 		case <-m.stopChan:
 			return
 		}
 	}
 }
 
-func (m *Manager) removeInactiveLimiters() {
-	cutoff := time.Now().Add(-10 * time.Minute)
-	
-	m.limiters.Range(func(key, value interface{}) bool {
-		limiter := value.(*IPLimiter)
-		limiter.mutex.RLock()
-		hasRecentRequests := false
-		
-		for _, req := range limiter.requests {
-			if req.Timestamp.After(cutoff) {
-				hasRecentRequests = true
-				break
+// sync sends the counts of approximate limiters to the store
+func (m *Manager) sync() {
+	ticker := time.NewTicker(m.shared.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, p := range *m.policies.Load() {
+				if l, ok := p.limiter.(*approxLimiter); ok {
+					l.sync(now)
+				}
 			}
+		case <-m.stopChan:
+			return
 		}
-		limiter.mutex.RUnlock()
-		
-		if !hasRecentRequests {
-			m.limiters.Delete(key)
-		}
-		
-		return true
-	})
+	}
 }
 
 func (m *Manager) Close() {
 	close(m.stopChan)
-}
-
-func (l *IPLimiter) Allow() bool {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	
-	now := time.Now()
-	windowStart := now.Add(-l.window)
-	
-	// Remove old requests outside the window
-	l.removeOldRequests(windowStart)
-	
-	// Check if we're under the limit
-	if len(l.requests) < l.limit {
-		l.requests = append(l.requests, Request{Timestamp: now})
-		return true
-	}
-	
-	return false
-}
-
-func (l *IPLimiter) removeOldRequests(windowStart time.Time) {
-	validRequests := make([]Request, 0, len(l.requests))
-	
-	for _, req := range l.requests {
-		if req.Timestamp.After(windowStart) {
-			validRequests = append(validRequests, req)
-		}
+	if m.shared != nil {
+		m.shared.Store.Close()
 	}
-	
-	l.requests = validRequests
-}
-
-func (l *IPLimiter) GetCurrentCount() int {
-	l.mutex.RLock()
-	defer l.mutex.RUnlock()
-	
-	now := time.Now()
-	windowStart := now.Add(-l.window)
-	
-	count := 0
-	for _, req := range l.requests {
-		if req.Timestamp.After(windowStart) {
-			count++
-		}
-	}
-	
-	return count
-} 
\ No newline at end of file
+}
@@ -0,0 +1,202 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcraScript runs GCRA (and so token_bucket, which allows the same traffic)
+// on a key holding the TAT in microseconds. Times come from the server's
+// clock so instances with skewed clocks agree.
+// ARGV: interval (µs), burst. Returns allowed, remaining, reset and retry
+// after (µs).
+const gcraScript = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local interval = tonumber(ARGV[1])
+local tolerance = interval * tonumber(ARGV[2])
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if not tat or tat < now then
+  tat = now
+end
+if tat + interval - now > tolerance then
+  return {0, 0, tat - now, tat + interval - now - tolerance}
+end
+tat = tat + interval
+redis.call('SET', KEYS[1], string.format('%.0f', tat), 'PX', math.ceil((tat - now) / 1000))
+return {1, math.floor((tolerance - (tat - now)) / interval), tat - now, 0}
+`
+
+// slidingWindowScript runs sliding_window on a hash of counters by window
+// number, the same one Add updates. Only the current and previous windows
+// are kept.
+// ARGV: limit, window (µs). Returns allowed, remaining, reset and retry after
+// (µs).
+const slidingWindowScript = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local index = math.floor(now / window)
+local elapsed = now - index * window
+local field = string.format('%.0f', index)
+local curr = tonumber(redis.call('HGET', KEYS[1], field)) or 0
+local prev = tonumber(redis.call('HGET', KEYS[1], string.format('%.0f', index - 1))) or 0
+local overlap = (window - elapsed) / window
+local allowed = 0
+local retry = 0
+if prev * overlap + curr < limit then
+  allowed = 1
+  curr = redis.call('HINCRBY', KEYS[1], field, 1)
+  redis.call('HDEL', KEYS[1], string.format('%.0f', index - 2))
+  redis.call('PEXPIRE', KEYS[1], math.ceil(2 * window / 1000))
+elseif curr < limit then
+  retry = window * (1 - (limit - curr) / prev) - elapsed + 1
+else
+  retry = 2 * window - window * limit / curr - elapsed + 1
+end
+local remaining = math.max(0, math.floor(limit - prev * overlap - curr))
+local reset = 0
+if curr > 0 then
+  reset = 2 * window - elapsed
+elseif prev > 0 then
+  reset = window - elapsed
+end
+return {allowed, remaining, reset, retry}
+`
+
+// RedisStore keeps shared rate limit state in Redis, or any server speaking
+// its protocol such as Valkey or KeyDB. Checks run as Lua scripts, so each
+// is atomic.
+type RedisStore struct {
+	client *respClient
+	prefix string
+}
+
+// NewRedisStore creates a store on the server at rawURL,
+// redis://[[user]:password@]host[:port][/db] or rediss:// for TLS, naming
+// its keys prefix followed by {policy:key}, and :windows for the
+// sliding_window counters. It doesn't connect until used.
+func NewRedisStore(rawURL, prefix string, poolSize int) (*RedisStore, error) {
+	if poolSize <= 0 {
+		poolSize = 16
+	}
+	client, err := newRESPClient(rawURL, poolSize)
+	if err != nil {
+		return nil, fmt.Errorf("rate limit store %s: %w", rawURL, err)
+	}
+	return &RedisStore{client: client, prefix: prefix}, nil
+}
+
+// key wraps key in braces, a hash tag, so that on a cluster the keys of one
+// policy key live in one slot
+func (s *RedisStore) key(key string) string {
+	return s.prefix + "{" + key + "}"
+}
+
+// windowsKey names the hash of sliding_window counters for key, apart from
+// the GCRA key so that changing a policy's algorithm doesn't clash
+func (s *RedisStore) windowsKey(key string) string {
+	return s.key(key) + ":windows"
+}
+
+func (s *RedisStore) Take(ctx context.Context, algorithm, key string, rate Rate) (Decision, error) {
+	var script, storeKey string
+	var args []string
+	switch algorithm {
+	case AlgorithmSlidingWindow:
+		script, storeKey = slidingWindowScript, s.windowsKey(key)
+		args = []string{strconv.Itoa(rate.Limit), strconv.FormatInt(microseconds(rate.Window), 10)}
+		rate.Burst = 0
+	default:
+		script, storeKey = gcraScript, s.key(key)
+		args = []string{strconv.FormatInt(microseconds(rate.interval()), 10), strconv.Itoa(rate.burst())}
+	}
+	reply, err := s.eval(ctx, script, storeKey, args...)
+	if err != nil {
+		return Decision{}, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 4 {
+		return Decision{}, fmt.Errorf("unexpected script reply %v", reply)
+	}
+	var n [4]int64
+	for i, v := range values {
+		if n[i], ok = v.(int64); !ok {
+			return Decision{}, fmt.Errorf("unexpected script reply %v", reply)
+		}
+	}
+	return Decision{
+		Allowed:    n[0] == 1,
+		Rate:       rate,
+		Remaining:  int(n[1]),
+		Reset:      time.Duration(n[2]) * time.Microsecond,
+		RetryAfter: time.Duration(n[3]) * time.Microsecond,
+	}, nil
+}
+
+// eval runs script, which touches no key but key, by its SHA1, loading it
+// first if the server doesn't have it cached
+func (s *RedisStore) eval(ctx context.Context, script, key string, args ...string) (interface{}, error) {
+	sum := sha1.Sum([]byte(script))
+	cmd := append([]string{"EVALSHA", hex.EncodeToString(sum[:]), "1", key}, args...)
+	reply, err := s.client.do(ctx, cmd...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		cmd[0], cmd[1] = "EVAL", script
+		reply, err = s.client.do(ctx, cmd...)
+	}
+	return reply, err
+}
+
+// Add sends HINCRBY, HDEL of the window before last, PEXPIRE and HGET of
+// the previous window for every count in one pipeline
+func (s *RedisStore) Add(ctx context.Context, counts []WindowCount) error {
+	const perCount = 4
+	cmds := make([][]string, 0, perCount*len(counts))
+	for _, c := range counts {
+		window := int64(c.Window)
+		index := c.Start / window
+		key := s.windowsKey(c.Key)
+		cmds = append(cmds,
+			[]string{"HINCRBY", key, strconv.FormatInt(index, 10), strconv.FormatInt(c.Count, 10)},
+			[]string{"HDEL", key, strconv.FormatInt(index-2, 10)},
+			[]string{"PEXPIRE", key, strconv.FormatInt(2*window/int64(time.Millisecond), 10)},
+			[]string{"HGET", key, strconv.FormatInt(index-1, 10)})
+	}
+	replies, err := s.client.pipeline(ctx, cmds...)
+	if err != nil {
+		return err
+	}
+	for i := range counts {
+		total, ok := replies[perCount*i].(int64)
+		if !ok {
+			return fmt.Errorf("HINCRBY: unexpected reply %v", replies[perCount*i])
+		}
+		counts[i].Count = total
+		switch prev := replies[perCount*i+3].(type) {
+		case string:
+			counts[i].Previous, _ = strconv.ParseInt(prev, 10, 64)
+		case respError:
+			return prev
+		}
+	}
+	return nil
+}
+
+func (s *RedisStore) Close() error {
+	s.client.close()
+	return nil
+}
+
+// microseconds converts d for the scripts, at least 1
+func microseconds(d time.Duration) int64 {
+	if us := d.Microseconds(); us > 0 {
+		return us
+	}
+	return 1
+}
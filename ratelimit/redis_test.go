@@ -0,0 +1,183 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// The tests run against miniredis, which runs the store's Lua scripts as
+// they are sent
+
+func newTestRedisStore(t *testing.T, m *miniredis.Miniredis, url string) *RedisStore {
+	t.Helper()
+	if url == "" {
+		url = "redis://" + m.Addr()
+	}
+	store, err := NewRedisStore(url, "test:", 4)
+	if err != nil {
+		t.Fatalf("NewRedisStore: %v", err)
+	}
+	return store
+}
+
+func TestRedisStoreTake(t *testing.T) {
+	m := miniredis.RunT(t)
+	m.RequireAuth("secret")
+	store := newTestRedisStore(t, m, "redis://:secret@"+m.Addr()+"/2")
+	defer store.Close()
+	ctx := context.Background()
+	rate := Rate{Limit: 3, Window: time.Minute}
+
+	for _, algorithm := range []string{AlgorithmGCRA, AlgorithmSlidingWindow} {
+		allowed := 0
+		for i := 0; i < 5; i++ {
+			d, err := store.Take(ctx, algorithm, algorithm+":client", rate)
+			if err != nil {
+				t.Fatalf("%s: Take: %v", algorithm, err)
+			}
+			if d.Allowed {
+				allowed++
+				if want := 3 - allowed; d.Remaining != want {
+					t.Errorf("%s: request %d: remaining %d, want %d", algorithm, i+1, d.Remaining, want)
+				}
+				if d.Reset <= 0 || d.Reset > 2*time.Minute {
+					t.Errorf("%s: request %d: reset %v", algorithm, i+1, d.Reset)
+				}
+			} else if d.RetryAfter <= 0 || d.RetryAfter > 2*time.Minute {
+				t.Errorf("%s: request %d denied with retry after %v", algorithm, i+1, d.RetryAfter)
+			}
+		}
+		if allowed != 3 {
+			t.Errorf("%s: allowed %d of 5, want 3", algorithm, allowed)
+		}
+	}
+
+	// The scripts keep their state in the keys they are passed, and nowhere
+	// else
+	keys := m.DB(2).Keys()
+	sort.Strings(keys)
+	want := []string{"test:{gcra:client}", "test:{sliding_window:client}:windows"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys %q, want %q", keys, want)
+	}
+
+	// After the server forgets the scripts they are sent again
+	if _, err := store.client.do(ctx, "SCRIPT", "FLUSH"); err != nil {
+		t.Fatalf("SCRIPT FLUSH: %v", err)
+	}
+	if d, err := store.Take(ctx, AlgorithmGCRA, "gcra:other", rate); err != nil || !d.Allowed {
+		t.Errorf("Take after SCRIPT FLUSH: %+v, %v", d, err)
+	}
+}
+
+func TestRedisStoreAdd(t *testing.T) {
+	m := miniredis.RunT(t)
+	store := newTestRedisStore(t, m, "")
+	defer store.Close()
+	ctx := context.Background()
+	window := time.Minute
+	start := int64(100 * window)
+
+	prev := []WindowCount{{Key: "p:a", Start: start - int64(window), Window: window, Count: 2}}
+	if err := store.Add(ctx, prev); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	counts := []WindowCount{
+		{Key: "p:a", Start: start, Window: window, Count: 3},
+		{Key: "p:b", Start: start, Window: window, Count: 1},
+	}
+	if err := store.Add(ctx, counts); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if counts[0].Count != 3 || counts[0].Previous != 2 {
+		t.Errorf("p:a: got total %d, previous %d; want 3, 2", counts[0].Count, counts[0].Previous)
+	}
+	if counts[1].Count != 1 || counts[1].Previous != 0 {
+		t.Errorf("p:b: got total %d, previous %d; want 1, 0", counts[1].Count, counts[1].Previous)
+	}
+
+	// A count two windows on drops the oldest window
+	next := []WindowCount{{Key: "p:a", Start: start + int64(window), Window: window, Count: 4}}
+	if err := store.Add(ctx, next); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if next[0].Count != 4 || next[0].Previous != 3 {
+		t.Errorf("p:a next window: got total %d, previous %d; want 4, 3", next[0].Count, next[0].Previous)
+	}
+	fields, _ := m.HKeys("test:{p:a}:windows")
+	sort.Strings(fields)
+	if want := []string{"100", "101"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("windows kept %q, want %q", fields, want)
+	}
+	if ttl := m.TTL("test:{p:a}:windows"); ttl != 2*window {
+		t.Errorf("windows expire in %v, want %v", ttl, 2*window)
+	}
+}
+
+// Add and the sliding_window script count in the same place
+func TestRedisStoreAddThenTake(t *testing.T) {
+	m := miniredis.RunT(t)
+	store := newTestRedisStore(t, m, "")
+	defer store.Close()
+	ctx := context.Background()
+	rate := Rate{Limit: 5, Window: time.Hour}
+
+	ns := time.Now().UnixNano()
+	counts := []WindowCount{{Key: "p:a", Start: ns - ns%int64(rate.Window), Window: rate.Window, Count: 4}}
+	if err := store.Add(ctx, counts); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if d, err := store.Take(ctx, AlgorithmSlidingWindow, "p:a", rate); err != nil || !d.Allowed || d.Remaining != 0 {
+		t.Errorf("fifth request: %+v, %v; want allowed with none remaining", d, err)
+	}
+	if d, err := store.Take(ctx, AlgorithmSlidingWindow, "p:a", rate); err != nil || d.Allowed {
+		t.Errorf("sixth request: %+v, %v; want denied", d, err)
+	}
+}
+
+func TestRedisStoreAuthFailure(t *testing.T) {
+	m := miniredis.RunT(t)
+	m.RequireAuth("secret")
+	store := newTestRedisStore(t, m, "redis://:wrong@"+m.Addr())
+	defer store.Close()
+	if _, err := store.Take(context.Background(), AlgorithmGCRA, "k", PerMinute(1, 1)); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Take with a wrong password: got error %v, want WRONGPASS", err)
+	}
+}
+
+// Two instances sharing a store enforce one limit between them
+func TestManagersShareExactCounts(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmTokenBucket, AlgorithmGCRA, AlgorithmSlidingWindow} {
+		t.Run(algorithm, func(t *testing.T) {
+			m := miniredis.RunT(t)
+			specs := []PolicySpec{{Name: "ip", Key: []string{"ip"}, Algorithm: algorithm, Rate: Rate{Limit: 4, Window: time.Minute, Burst: 4}}}
+			var managers [2]*Manager
+			for i := range managers {
+				manager, err := New(specs, 0, &Shared{Store: newTestRedisStore(t, m, ""), Timeout: time.Second})
+				if err != nil {
+					t.Fatalf("New: %v", err)
+				}
+				defer manager.Close()
+				managers[i] = manager
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			allowed := 0
+			for i := 0; i < 10; i++ {
+				if managers[i%2].Allow(r, "10.0.0.1", "").Allowed() {
+					allowed++
+				}
+			}
+			if allowed != 4 {
+				t.Errorf("allowed %d of 10 across both instances, want 4", allowed)
+			}
+		})
+	}
+}
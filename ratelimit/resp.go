@@ -0,0 +1,230 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// respError is an error reply from the server
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+// respClient is a minimal client for the Redis serialization protocol
+// (RESP2), with a pool of connections
+type respClient struct {
+	addr     string
+	tls      *tls.Config
+	username string
+	password string
+	db       int
+	idle     chan *respConn
+}
+
+type respConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// newRESPClient parses redis://[[user]:password@]host[:port][/db], or
+// rediss:// for TLS. Connections are made on first use.
+func newRESPClient(rawURL string, poolSize int) (*respClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &respClient{addr: u.Host, idle: make(chan *respConn, poolSize)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q (want redis or rediss)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// pipeline sends cmds in one write and returns their replies. An error
+// reply is returned as a respError in its place; other errors close the
+// connection.
+func (c *respClient) pipeline(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.roundTrip(ctx, cmds)
+	if err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return replies, nil
+}
+
+// do sends one command and returns its reply
+func (c *respClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := c.pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(respError); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+func (c *respClient) get(ctx context.Context) (*respConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		conn, err = (&tls.Dialer{Config: c.tls}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &respConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+
+	var setup [][]string
+	switch {
+	case c.username != "":
+		setup = append(setup, []string{"AUTH", c.username, c.password})
+	case c.password != "":
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		replies, err := rc.roundTrip(ctx, setup)
+		if err == nil {
+			for _, reply := range replies {
+				if e, ok := reply.(respError); ok {
+					err = e
+				}
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("connecting to %s: %w", c.addr, err)
+		}
+	}
+	return rc, nil
+}
+
+func (c *respClient) put(conn *respConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+func (c *respClient) close() {
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (rc *respConn) roundTrip(ctx context.Context, cmds [][]string) ([]interface{}, error) {
+	// No deadline clears any earlier one
+	deadline, _ := ctx.Deadline()
+	rc.conn.SetDeadline(deadline)
+	for _, args := range cmds {
+		fmt.Fprintf(rc.writer, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(rc.writer, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := rc.writer.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range replies {
+		reply, err := readReply(rc.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// readReply reads one reply: a string, int64, nil, respError or a slice of
+// replies
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return respError(value), nil
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elements := make([]interface{}, n)
+		for i := range elements {
+			if elements[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+	return nil, fmt.Errorf("invalid reply %q", line)
+}
@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want interface{}
+	}{
+		{"simple string", "+OK\r\n", "OK"},
+		{"error", "-NOSCRIPT No matching script\r\n", respError("NOSCRIPT No matching script")},
+		{"integer", ":-42\r\n", int64(-42)},
+		{"bulk string", "$5\r\na\r\nbc\r\n", "a\r\nbc"},
+		{"empty bulk string", "$0\r\n\r\n", ""},
+		{"null bulk string", "$-1\r\n", nil},
+		{"null array", "*-1\r\n", nil},
+		{"nested array", "*3\r\n:1\r\n*2\r\n+a\r\n$-1\r\n$1\r\nb\r\n", []interface{}{int64(1), []interface{}{"a", nil}, "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.in))
+			got, err := readReply(r)
+			if err != nil {
+				t.Fatalf("readReply(%q): %v", tt.in, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readReply(%q) = %#v, want %#v", tt.in, got, tt.want)
+			}
+			if r.Buffered() != 0 {
+				t.Errorf("readReply(%q) left %d bytes unread", tt.in, r.Buffered())
+			}
+		})
+	}
+
+	for _, in := range []string{"", "+OK\n", "?1\r\n", ":x\r\n", "$5\r\nab\r\n", "*2\r\n:1\r\n"} {
+		if got, err := readReply(bufio.NewReader(strings.NewReader(in))); err == nil {
+			t.Errorf("readReply(%q) = %#v, want an error", in, got)
+		}
+	}
+}
+
+func TestNewRESPClient(t *testing.T) {
+	tests := []struct {
+		url                string
+		addr               string
+		username, password string
+		db                 int
+		tls                bool
+	}{
+		{url: "redis://cache", addr: "cache:6379"},
+		{url: "redis://cache:6380/3", addr: "cache:6380", db: 3},
+		{url: "redis://:secret@cache", addr: "cache:6379", password: "secret"},
+		{url: "rediss://proxy:s3cret@[::1]:6390/0", addr: "[::1]:6390", username: "proxy", password: "s3cret", tls: true},
+	}
+	for _, tt := range tests {
+		c, err := newRESPClient(tt.url, 1)
+		if err != nil {
+			t.Errorf("newRESPClient(%q): %v", tt.url, err)
+			continue
+		}
+		if c.addr != tt.addr || c.username != tt.username || c.password != tt.password || c.db != tt.db || (c.tls != nil) != tt.tls {
+			t.Errorf("newRESPClient(%q) = addr %q, user %q, password %q, db %d, tls %v", tt.url, c.addr, c.username, c.password, c.db, c.tls != nil)
+		}
+	}
+
+	for _, url := range []string{"http://cache", "redis://", "redis://cache/one", "redis://cache:%zz"} {
+		if _, err := newRESPClient(url, 1); err == nil {
+			t.Errorf("newRESPClient(%q): want an error", url)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// shardCount spreads keys over several locks so requests from different
+// clients rarely contend
+const shardCount = 64
+
+// shardedState holds one small state value S per key
+type shardedState[S any] struct {
+	shards [shardCount]stateShard[S]
+}
+
+type stateShard[S any] struct {
+	mu     sync.Mutex
+	states map[string]S
+}
+
+func newShardedState[S any]() *shardedState[S] {
+	s := &shardedState[S]{}
+	for i := range s.shards {
+		s.shards[i].states = make(map[string]S)
+	}
+	return s
+}
+
+// shard picks the shard for key with FNV-1a, inlined to avoid allocating
+func (s *shardedState[S]) shard(key string) *stateShard[S] {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &s.shards[h%shardCount]
+}
+
+// lock locks and returns the shard holding key; the caller unlocks it
+func (s *shardedState[S]) lock(key string) *stateShard[S] {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	return sh
+}
+
+// sweep deletes the keys whose state idle reports as idle
+func (s *shardedState[S]) sweep(idle func(state S) bool) int {
+	removed := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for key, state := range sh.states {
+			if idle(state) {
+				delete(sh.states, key)
+				removed++
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return removed
+}
+
+func (s *shardedState[S]) len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		n += len(sh.states)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// currentRate holds a Rate that can be swapped while in use
+type currentRate struct {
+	rate atomic.Pointer[Rate]
+}
+
+func (c *currentRate) SetRate(rate Rate) {
+	c.rate.Store(&rate)
+}
+
+func (c *currentRate) load() Rate {
+	return *c.rate.Load()
+}
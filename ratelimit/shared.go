@@ -0,0 +1,132 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sharedLimiter checks every request in the store, and falls back to a
+// local limiter while the store is unavailable
+type sharedLimiter struct {
+	currentRate
+	guard     *storeGuard
+	policy    string
+	algorithm string
+	local     Limiter
+}
+
+func newSharedLimiter(guard *storeGuard, policy, algorithm string, local Limiter, rate Rate) *sharedLimiter {
+	l := &sharedLimiter{guard: guard, policy: policy, algorithm: algorithm, local: local}
+	l.currentRate.SetRate(rate)
+	return l
+}
+
+func (l *sharedLimiter) Allow(key string, now time.Time) Decision {
+	if l.guard.use(now) {
+		ctx, cancel := l.guard.context()
+		d, err := l.guard.Store.Take(ctx, l.algorithm, l.policy+":"+key, l.load())
+		cancel()
+		if err == nil {
+			l.guard.succeeded()
+			return d
+		}
+		l.guard.failed(err, now)
+	}
+	return l.local.Allow(key, now)
+}
+
+func (l *sharedLimiter) SetRate(rate Rate) {
+	l.currentRate.SetRate(rate)
+	l.local.SetRate(rate)
+}
+
+func (l *sharedLimiter) Sweep(now time.Time) int { return l.local.Sweep(now) }
+
+func (l *sharedLimiter) Len() int { return l.local.Len() }
+
+// approxLimiter decides locally with a sliding window, and periodically adds
+// its counts to the store and takes back the totals of all instances
+type approxLimiter struct {
+	*slidingWindow
+	guard  *storeGuard
+	policy string
+
+	mu sync.Mutex
+	// pending counts requests allowed since the last sync, per key and window
+	pending map[windowKey]int64
+}
+
+type windowKey struct {
+	key   string
+	start int64
+}
+
+func newApproxLimiter(guard *storeGuard, policy string, rate Rate) *approxLimiter {
+	return &approxLimiter{
+		slidingWindow: newSlidingWindow(rate),
+		guard:         guard,
+		policy:        policy,
+		pending:       make(map[windowKey]int64),
+	}
+}
+
+func (l *approxLimiter) Allow(key string, now time.Time) Decision {
+	d := l.slidingWindow.Allow(key, now)
+	if d.Allowed {
+		ns := now.UnixNano()
+		window := windowKey{key: key, start: ns - ns%int64(d.Rate.Window)}
+		l.mu.Lock()
+		l.pending[window]++
+		l.mu.Unlock()
+	}
+	return d
+}
+
+// sync sends the pending counts to the store and merges the totals into the
+// local windows. While the store is unavailable the counts are dropped, and
+// each instance enforces the limit on its own.
+func (l *approxLimiter) sync(now time.Time) {
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = make(map[windowKey]int64, len(pending))
+	l.mu.Unlock()
+	if len(pending) == 0 || !l.guard.use(now) {
+		return
+	}
+
+	window := l.load().Window
+	counts := make([]WindowCount, 0, len(pending))
+	for w, n := range pending {
+		counts = append(counts, WindowCount{Key: l.policy + ":" + w.key, Start: w.start, Window: window, Count: n})
+	}
+	ctx, cancel := l.guard.context()
+	err := l.guard.Store.Add(ctx, counts)
+	cancel()
+	if err != nil {
+		l.guard.failed(err, now)
+		return
+	}
+	l.guard.succeeded()
+
+	prefix := len(l.policy) + 1
+	for _, c := range counts {
+		key := c.Key[prefix:]
+		sh := l.windows.lock(key)
+		if w, ok := sh.states[key]; ok {
+			// Requests allowed here since the counts were taken aren't in
+			// the totals yet
+			l.mu.Lock()
+			since := l.pending[windowKey{key: key, start: c.Start}]
+			l.mu.Unlock()
+			switch w.start {
+			case c.Start:
+				w.prev = max(w.prev, int32(c.Previous))
+				w.curr = int32(c.Count + since)
+			case c.Start + int64(window):
+				w.prev = max(w.prev, int32(c.Count))
+			}
+			sh.states[key] = w
+		}
+		sh.mu.Unlock()
+	}
+}
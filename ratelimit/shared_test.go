@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// countingStore counts the calls made to a Store
+type countingStore struct {
+	Store
+	takes, adds atomic.Int64
+}
+
+func (s *countingStore) Take(ctx context.Context, algorithm, key string, rate Rate) (Decision, error) {
+	s.takes.Add(1)
+	return s.Store.Take(ctx, algorithm, key, rate)
+}
+
+func (s *countingStore) Add(ctx context.Context, counts []WindowCount) error {
+	s.adds.Add(1)
+	return s.Store.Add(ctx, counts)
+}
+
+// When the store goes down requests are counted locally, and once it is
+// back and the retry interval has passed it is used again
+func TestSharedLimiterFallsBackToLocal(t *testing.T) {
+	m := miniredis.RunT(t)
+	store := &countingStore{Store: newTestRedisStore(t, m, "")}
+	specs := []PolicySpec{{Name: "ip", Key: []string{"ip"}, Algorithm: AlgorithmGCRA, Rate: Rate{Limit: 2, Window: time.Minute, Burst: 2}}}
+	manager, err := New(specs, 0, &Shared{Store: store, Timeout: time.Second, RetryInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer manager.Close()
+	r := httptest.NewRequest("GET", "/", nil)
+	allow := func() bool { return manager.Allow(r, "10.0.0.1", "").Allowed() }
+
+	if !allow() || !allow() || allow() {
+		t.Fatal("want 2 requests allowed by the store, then a denial")
+	}
+
+	m.Close()
+	if !allow() {
+		t.Error("with the store down, the first request should be allowed by the fresh local limiter")
+	}
+	if manager.shared.retryAt.Load() == 0 {
+		t.Error("the store failure wasn't recorded")
+	}
+	takes := store.takes.Load()
+	if !allow() || allow() {
+		t.Error("with the store down, the local limiter should allow 2 requests")
+	}
+	if n := store.takes.Load(); n != takes {
+		t.Errorf("the store was called %d times before the retry interval passed", n-takes)
+	}
+
+	if err := m.Restart(); err != nil {
+		t.Fatalf("Restart: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// The store still holds the 2 requests from before
+	if allow() {
+		t.Error("after the store came back, the request should be denied by its counts")
+	}
+	if store.takes.Load() == takes {
+		t.Error("the store wasn't tried again after the retry interval")
+	}
+	if manager.shared.retryAt.Load() != 0 {
+		t.Error("the store's recovery wasn't recorded")
+	}
+}
+
+// In approximate mode each instance decides locally, and sync adds its
+// counts to the store and takes back the totals of every instance
+func TestApproxLimiterSync(t *testing.T) {
+	m := miniredis.RunT(t)
+	specs := []PolicySpec{{Name: "ip", Key: []string{"ip"}, Algorithm: AlgorithmSlidingWindow, Rate: Rate{Limit: 4, Window: time.Hour}}}
+	var managers [2]*Manager
+	var stores [2]*countingStore
+	var limiters [2]*approxLimiter
+	for i := range managers {
+		stores[i] = &countingStore{Store: newTestRedisStore(t, m, "")}
+		// A long sync interval so that only the test syncs
+		manager, err := New(specs, 0, &Shared{Store: stores[i], Timeout: time.Second, Approximate: true, SyncInterval: time.Hour})
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		defer manager.Close()
+		managers[i] = manager
+		limiters[i] = (*manager.policies.Load())[0].limiter.(*approxLimiter)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	allow := func(i int) bool { return managers[i].Allow(r, "10.0.0.1", "").Allowed() }
+
+	for i := 0; i < 3; i++ {
+		if !allow(0) {
+			t.Fatalf("instance 0: request %d denied", i+1)
+		}
+	}
+	if n := stores[0].takes.Load() + stores[0].adds.Load(); n != 0 {
+		t.Fatalf("the store was called %d times before a sync", n)
+	}
+	limiters[0].sync(time.Now())
+	if n := stores[0].adds.Load(); n != 1 {
+		t.Errorf("sync sent %d batches, want 1", n)
+	}
+	limiters[0].sync(time.Now())
+	if n := stores[0].adds.Load(); n != 1 {
+		t.Error("sync with nothing pending called the store")
+	}
+
+	// Instance 1 hasn't seen instance 0's requests until it syncs
+	if !allow(1) {
+		t.Fatal("instance 1: first request denied")
+	}
+	limiters[1].sync(time.Now())
+	if allow(1) {
+		t.Error("instance 1 allowed a fifth request after taking back the totals")
+	}
+
+	ns := time.Now().UnixNano()
+	window := int64(time.Hour)
+	var total int64
+	for _, index := range []int64{ns/window - 1, ns / window} {
+		n, _ := strconv.ParseInt(m.HGet("test:{ip:10.0.0.1}:windows", strconv.FormatInt(index, 10)), 10, 64)
+		total += n
+	}
+	if total != 4 {
+		t.Errorf("store counted %d requests, want 4", total)
+	}
+}
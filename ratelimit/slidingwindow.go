@@ -0,0 +1,81 @@
+package ratelimit
+
+import "time"
+
+// slidingWindow approximates a sliding log with two counters per key: the
+// requests in the current fixed window, and in the previous one weighted by
+// how much of it the sliding window still covers
+type slidingWindow struct {
+	currentRate
+	windows *shardedState[windowCount]
+}
+
+type windowCount struct {
+	// start of the current window, in Unix nanoseconds
+	start      int64
+	prev, curr int32
+}
+
+func newSlidingWindow(rate Rate) *slidingWindow {
+	l := &slidingWindow{windows: newShardedState[windowCount]()}
+	l.SetRate(rate)
+	return l
+}
+
+func (l *slidingWindow) Allow(key string, now time.Time) Decision {
+	rate := l.load()
+	window := int64(rate.Window)
+	ns := now.UnixNano()
+	start := ns - ns%window
+	sh := l.windows.lock(key)
+	defer sh.mu.Unlock()
+	w, found := sh.states[key]
+	switch {
+	case !found || w.start < start-window:
+		w = windowCount{start: start}
+	case w.start < start:
+		w = windowCount{start: start, prev: w.curr}
+	}
+	overlap := float64(window-(ns-start)) / float64(window)
+	limit := float64(rate.Limit)
+	rate.Burst = 0
+	d := Decision{Allowed: float64(w.prev)*overlap+float64(w.curr) < limit, Rate: rate}
+	if d.Allowed {
+		w.curr++
+	} else {
+		d.RetryAfter = w.retryAfter(limit, window, ns)
+	}
+	sh.states[key] = w
+	if remaining := limit - float64(w.prev)*overlap - float64(w.curr); remaining > 0 {
+		d.Remaining = int(remaining)
+	}
+	// Both counts have aged out once the window after the last counted
+	// request has passed
+	switch {
+	case w.curr > 0:
+		d.Reset = time.Duration(w.start + 2*window - ns)
+	case w.prev > 0:
+		d.Reset = time.Duration(w.start + window - ns)
+	}
+	return d
+}
+
+// retryAfter returns how long until the weighted count drops below limit
+func (w windowCount) retryAfter(limit float64, window, now int64) time.Duration {
+	if curr := float64(w.curr); curr < limit {
+		// Wait for the previous window's weight to fall far enough
+		elapsed := float64(window) * (1 - (limit-curr)/float64(w.prev))
+		return time.Duration(w.start + int64(elapsed) + 1 - now)
+	}
+	// Wait until the current window, as the previous one, weighs little enough
+	elapsed := float64(window) * (1 - limit/float64(w.curr))
+	return time.Duration(w.start + window + int64(elapsed) + 1 - now)
+}
+
+func (l *slidingWindow) Sweep(now time.Time) int {
+	window := int64(l.load().Window)
+	ns := now.UnixNano()
+	return l.windows.sweep(func(w windowCount) bool { return ns >= w.start+2*window })
+}
+
+func (l *slidingWindow) Len() int { return l.windows.len() }
@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Store holds rate limit state shared by every goproxy instance, so that
+// replicas enforce one limit between them instead of one each.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Take checks one request for key against rate with the named
+	// algorithm, and counts it if allowed, in one atomic step
+	Take(ctx context.Context, algorithm, key string, rate Rate) (Decision, error)
+	// Add adds each count to its key's fixed window counter, then fills in
+	// the new total and the total of the window before
+	Add(ctx context.Context, counts []WindowCount) error
+	Close() error
+}
+
+// WindowCount is the number of requests for a key in one fixed window
+type WindowCount struct {
+	Key string
+	// Start is the start of the window, in Unix nanoseconds
+	Start  int64
+	Window time.Duration
+	// Count is the number of requests to add, and after Add the total
+	Count int64
+	// Previous is set by Add to the total of the window before
+	Previous int64
+}
+
+// Shared configures counting in a Store
+type Shared struct {
+	Store Store
+	// Timeout bounds each call to the store
+	Timeout time.Duration
+	// Approximate counts requests in the instance and adds the counts to the
+	// store every SyncInterval, instead of calling the store on every
+	// request. Between syncs, instances don't see each other's requests, so
+	// together they may allow more than the limit. Only sliding_window
+	// policies can be counted this way.
+	Approximate  bool
+	SyncInterval time.Duration
+	// RetryInterval is how long to count locally, as if not shared, after
+	// the store fails
+	RetryInterval time.Duration
+}
+
+// storeGuard tracks the store's health so that requests are counted
+// locally, rather than waiting on a store that is down
+type storeGuard struct {
+	Shared
+	// retryAt is when to try the store again in Unix nanoseconds, or 0 while
+	// it works
+	retryAt atomic.Int64
+}
+
+// use reports whether to call the store. Once the retry time passes, one
+// caller tries it while the others keep counting locally.
+func (g *storeGuard) use(now time.Time) bool {
+	retryAt := g.retryAt.Load()
+	if retryAt == 0 {
+		return true
+	}
+	ns := now.UnixNano()
+	return ns >= retryAt && g.retryAt.CompareAndSwap(retryAt, ns+int64(g.RetryInterval))
+}
+
+func (g *storeGuard) failed(err error, now time.Time) {
+	if g.retryAt.Swap(now.Add(g.RetryInterval).UnixNano()) == 0 {
+		log.Printf("Rate limit store unavailable, counting locally: %v", err)
+	}
+}
+
+func (g *storeGuard) succeeded() {
+	if g.retryAt.Load() != 0 && g.retryAt.Swap(0) != 0 {
+		log.Printf("Rate limit store available again")
+	}
+}
+
+func (g *storeGuard) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), g.Timeout)
+}
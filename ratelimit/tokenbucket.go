@@ -0,0 +1,66 @@
+package ratelimit
+
+import "time"
+
+// tokenBucket gives each key a bucket holding up to Burst tokens, refilled
+// continuously at the rate; a request takes one token
+type tokenBucket struct {
+	currentRate
+	buckets *shardedState[bucket]
+}
+
+type bucket struct {
+	tokens float64
+	// last is when tokens was computed, in Unix nanoseconds
+	last int64
+}
+
+func newTokenBucket(rate Rate) *tokenBucket {
+	l := &tokenBucket{buckets: newShardedState[bucket]()}
+	l.SetRate(rate)
+	return l
+}
+
+// refill returns the tokens in b at now
+func (b bucket) refill(rate Rate, now int64) float64 {
+	capacity := float64(rate.burst())
+	tokens := b.tokens + float64(now-b.last)*rate.perNanosecond()
+	if tokens > capacity {
+		return capacity
+	}
+	return tokens
+}
+
+func (l *tokenBucket) Allow(key string, now time.Time) Decision {
+	rate := l.load()
+	ns := now.UnixNano()
+	sh := l.buckets.lock(key)
+	defer sh.mu.Unlock()
+	b, found := sh.states[key]
+	if found {
+		b.tokens = b.refill(rate, ns)
+	} else {
+		b.tokens = float64(rate.burst())
+	}
+	b.last = ns
+	d := Decision{Allowed: b.tokens >= 1, Rate: rate}
+	if d.Allowed {
+		b.tokens--
+	} else {
+		d.RetryAfter = time.Duration((1 - b.tokens) / rate.perNanosecond())
+	}
+	sh.states[key] = b
+	d.Remaining = int(b.tokens)
+	d.Reset = time.Duration((float64(rate.burst()) - b.tokens) / rate.perNanosecond())
+	return d
+}
+
+func (l *tokenBucket) Sweep(now time.Time) int {
+	rate := l.load()
+	ns := now.UnixNano()
+	return l.buckets.sweep(func(b bucket) bool {
+		return b.refill(rate, ns) >= float64(rate.burst())
+	})
+}
+
+func (l *tokenBucket) Len() int { return l.buckets.len() }
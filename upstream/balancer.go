@@ -0,0 +1,184 @@
+package upstream
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Load-balancing strategy names accepted in config
+const (
+	StrategyRoundRobin         = "round_robin"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyLeastConnections   = "least_connections"
+	StrategyPowerOfTwo         = "random_two_choices"
+	StrategyConsistentHash     = "consistent_hash"
+)
+
+// LoadBalancer picks one of the candidate targets for a request. key is only
+// meaningful to hashing strategies. Implementations must be safe for
+// concurrent use.
+type LoadBalancer interface {
+	Next(candidates []*Target, key string) *Target
+}
+
+// NewLoadBalancer returns the strategy with the given name for targets
+func NewLoadBalancer(strategy string, targets []*Target) (LoadBalancer, error) {
+	switch strategy {
+	case "", StrategyRoundRobin:
+		return &roundRobin{}, nil
+	case StrategyWeightedRoundRobin:
+		return &weightedRoundRobin{current: make(map[*Target]int)}, nil
+	case StrategyLeastConnections:
+		return &leastConnections{}, nil
+	case StrategyPowerOfTwo:
+		return &powerOfTwo{rnd: rand.New(rand.NewSource(rand.Int63()))}, nil
+	case StrategyConsistentHash:
+		return newConsistentHash(targets), nil
+	default:
+		return nil, fmt.Errorf("unknown load_balancer %q", strategy)
+	}
+}
+
+// roundRobin cycles through candidates in order
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func (b *roundRobin) Next(candidates []*Target, key string) *Target {
+	if len(candidates) == 0 {
+		return nil
+	}
+	n := b.next.Add(1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// weightedRoundRobin is nginx-style smooth weighted round robin, which
+// interleaves heavy targets instead of sending them bursts
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*Target]int
+}
+
+func (b *weightedRoundRobin) Next(candidates []*Target, key string) *Target {
+	if len(candidates) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *Target
+	total := 0
+	for _, t := range candidates {
+		b.current[t] += t.Weight
+		total += t.Weight
+		if best == nil || b.current[t] > b.current[best] {
+			best = t
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// leastConnections picks the target with the fewest in-flight requests
+// relative to its weight
+type leastConnections struct {
+	tieBreak atomic.Uint64
+}
+
+func (b *leastConnections) Next(candidates []*Target, key string) *Target {
+	if len(candidates) == 0 {
+		return nil
+	}
+	// Start from a rotating offset so ties don't always land on the first target
+	offset := int(b.tieBreak.Add(1) % uint64(len(candidates)))
+	var best *Target
+	for i := range candidates {
+		t := candidates[(offset+i)%len(candidates)]
+		if best == nil || t.InFlight()*int64(best.Weight) < best.InFlight()*int64(t.Weight) {
+			best = t
+		}
+	}
+	return best
+}
+
+// powerOfTwo samples two random targets and keeps the less loaded one
+type powerOfTwo struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func (b *powerOfTwo) Next(candidates []*Target, key string) *Target {
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+	b.mu.Lock()
+	i := b.rnd.Intn(len(candidates))
+	j := b.rnd.Intn(len(candidates) - 1)
+	b.mu.Unlock()
+	if j >= i {
+		j++
+	}
+	a, c := candidates[i], candidates[j]
+	if c.InFlight()*int64(a.Weight) < a.InFlight()*int64(c.Weight) {
+		return c
+	}
+	return a
+}
+
+// consistentHash maps keys onto a ring of virtual nodes so each key sticks to
+// the same target, and only a fraction of keys move when targets change
+type consistentHash struct {
+	ring []ringNode
+}
+
+type ringNode struct {
+	hash   uint32
+	target *Target
+}
+
+const virtualNodesPerWeight = 100
+
+func newConsistentHash(targets []*Target) *consistentHash {
+	b := &consistentHash{}
+	for _, t := range targets {
+		for i := 0; i < virtualNodesPerWeight*t.Weight; i++ {
+			b.ring = append(b.ring, ringNode{hash: hashString(t.String() + "#" + strconv.Itoa(i)), target: t})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	return b
+}
+
+func (b *consistentHash) Next(candidates []*Target, key string) *Target {
+	if len(candidates) == 0 || len(b.ring) == 0 {
+		return nil
+	}
+	allowed := make(map[*Target]bool, len(candidates))
+	for _, t := range candidates {
+		allowed[t] = true
+	}
+	h := hashString(key)
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	// Walk clockwise past targets that aren't candidates right now
+	for i := 0; i < len(b.ring); i++ {
+		node := b.ring[(start+i)%len(b.ring)]
+		if allowed[node.target] {
+			return node.target
+		}
+	}
+	return nil
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,183 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Outcome is the result of a request as seen by the circuit breaker
+type Outcome int
+
+const (
+	// OutcomeSuccess closes a half-open breaker and resets the failure count
+	OutcomeSuccess Outcome = iota
+	// OutcomeFailure is a connection error, 5xx or slow response
+	OutcomeFailure
+	// OutcomeIgnored releases a half-open probe slot without counting either
+	// way, e.g. when the client went away
+	OutcomeIgnored
+)
+
+// BreakerSettings configures a circuit breaker
+type BreakerSettings struct {
+	// ConsecutiveFailures opens the circuit once reached
+	ConsecutiveFailures int
+	// LatencyThreshold counts responses slower than this as failures (0 disables)
+	LatencyThreshold time.Duration
+	// OpenDuration is how long the circuit stays open before probing
+	OpenDuration time.Duration
+	// HalfOpenRequests is how many probes may run at once while half-open;
+	// that many consecutive successes close the circuit
+	HalfOpenRequests int
+	// FailStatus and FailBody are returned while the circuit is open
+	FailStatus int
+	FailBody   string
+}
+
+// Breaker is a consecutive-failure circuit breaker. It is closed while the
+// upstream is healthy, opens after too many failures and fails requests fast,
+// then after OpenDuration lets a few probe requests through (half-open) to
+// decide whether to close again.
+type Breaker struct {
+	Settings BreakerSettings
+
+	mu                sync.Mutex
+	state             BreakerState
+	failures          int
+	openedAt          time.Time
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+	onStateChange     func(from, to BreakerState)
+}
+
+// NewBreaker creates a closed breaker. onStateChange, if set, is called on
+// every transition while the breaker's lock is held, so it must not call back
+// into the breaker.
+func NewBreaker(settings BreakerSettings, onStateChange func(from, to BreakerState)) *Breaker {
+	return &Breaker{Settings: settings.WithDefaults(), onStateChange: onStateChange}
+}
+
+// WithDefaults fills in zero fields with the default settings
+func (s BreakerSettings) WithDefaults() BreakerSettings {
+	if s.ConsecutiveFailures <= 0 {
+		s.ConsecutiveFailures = 5
+	}
+	if s.OpenDuration <= 0 {
+		s.OpenDuration = 30 * time.Second
+	}
+	if s.HalfOpenRequests <= 0 {
+		s.HalfOpenRequests = 1
+	}
+	if s.FailStatus == 0 {
+		s.FailStatus = 503
+	}
+	return s
+}
+
+// State returns the current state, moving open to half-open if its time is up
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checkOpenExpiredLocked(time.Now())
+	return b.state
+}
+
+// Allow reports whether a request may proceed. Every allowed request must be
+// followed by exactly one call to Record.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.checkOpenExpiredLocked(time.Now())
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.halfOpenInFlight >= b.Settings.HalfOpenRequests {
+			return false
+		}
+		b.halfOpenInFlight++
+	}
+	return true
+}
+
+// Record reports the outcome of a request that Allow let through. latency is
+// compared against LatencyThreshold for otherwise successful requests.
+func (b *Breaker) Record(outcome Outcome, latency time.Duration) {
+	if outcome == OutcomeSuccess && b.Settings.LatencyThreshold > 0 && latency > b.Settings.LatencyThreshold {
+		outcome = OutcomeFailure
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen && b.halfOpenInFlight > 0 {
+		b.halfOpenInFlight--
+	}
+
+	switch outcome {
+	case OutcomeSuccess:
+		b.failures = 0
+		if b.state == BreakerHalfOpen {
+			b.halfOpenSuccesses++
+			if b.halfOpenSuccesses >= b.Settings.HalfOpenRequests {
+				b.setStateLocked(BreakerClosed)
+			}
+		}
+	case OutcomeFailure:
+		switch b.state {
+		case BreakerHalfOpen:
+			b.openLocked()
+		case BreakerClosed:
+			b.failures++
+			if b.failures >= b.Settings.ConsecutiveFailures {
+				b.openLocked()
+			}
+		}
+	}
+}
+
+func (b *Breaker) checkOpenExpiredLocked(now time.Time) {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.Settings.OpenDuration {
+		b.setStateLocked(BreakerHalfOpen)
+	}
+}
+
+func (b *Breaker) openLocked() {
+	b.openedAt = time.Now()
+	b.setStateLocked(BreakerOpen)
+}
+
+func (b *Breaker) setStateLocked(to BreakerState) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+	b.failures = 0
+	b.halfOpenInFlight = 0
+	b.halfOpenSuccesses = 0
+	if b.onStateChange != nil {
+		b.onStateChange(from, to)
+	}
+}
@@ -0,0 +1,126 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HealthCheck configures active probing of a pool's targets
+type HealthCheck struct {
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// ExpectedStatus lists acceptable status codes; empty accepts 200-399
+	ExpectedStatus []int
+	// ExpectedBody must appear in the response body when set
+	ExpectedBody string
+	// HealthyThreshold consecutive passes bring a target back into rotation,
+	// UnhealthyThreshold consecutive failures take it out
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// maxHealthBody caps how much of a probe response is read for body matching
+const maxHealthBody = 64 << 10
+
+// StartHealthChecks probes every target in the background until
+// StopHealthChecks is called. onChange is called whenever a target's health
+// flips.
+func (p *Pool) StartHealthChecks(hc HealthCheck, client *http.Client, onChange func(t *Target, healthy bool)) {
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = 1
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = 1
+	}
+	p.stopHealth = make(chan struct{})
+	for _, t := range p.Targets {
+		go runHealthCheck(t, hc, client, p.stopHealth, onChange)
+	}
+}
+
+// StopHealthChecks stops the probes started by StartHealthChecks
+func (p *Pool) StopHealthChecks() {
+	if p.stopHealth != nil {
+		close(p.stopHealth)
+		p.stopHealth = nil
+	}
+}
+
+func runHealthCheck(t *Target, hc HealthCheck, client *http.Client, stop <-chan struct{}, onChange func(t *Target, healthy bool)) {
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	successes, failures := 0, 0
+	for {
+		if probe(t, hc, client) {
+			successes++
+			failures = 0
+			if !t.Healthy() && successes >= hc.HealthyThreshold {
+				t.healthy.Store(true)
+				onChange(t, true)
+			}
+		} else {
+			failures++
+			successes = 0
+			if t.Healthy() && failures >= hc.UnhealthyThreshold {
+				t.healthy.Store(false)
+				onChange(t, false)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func probe(t *Target, hc HealthCheck, client *http.Client) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+
+	u := *t.URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + hc.Path
+	u.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", "goproxy-health-check")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if !statusExpected(resp.StatusCode, hc.ExpectedStatus) {
+		return false
+	}
+	if hc.ExpectedBody == "" {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxHealthBody))
+		return true
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(body), hc.ExpectedBody)
+}
+
+func statusExpected(code int, expected []int) bool {
+	if len(expected) == 0 {
+		return code >= 200 && code < 400
+	}
+	for _, c := range expected {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
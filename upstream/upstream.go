@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// Target is a single backend server in a pool
+type Target struct {
+	URL *url.URL
+	// Weight 0 drains the target: it is kept, and health checked, but gets
+	// no traffic
+	Weight int
+
+	inFlight atomic.Int64
+	healthy  atomic.Bool
+}
+
+// NewTarget creates a target that starts out healthy
+func NewTarget(u *url.URL, weight int) *Target {
+	t := &Target{URL: u, Weight: weight}
+	t.healthy.Store(true)
+	return t
+}
+
+// Healthy reports whether the target is in the load-balancing rotation
+func (t *Target) Healthy() bool {
+	return t.healthy.Load()
+}
+
+// SetHealthy overrides the target's health, e.g. to carry state across a reload
+func (t *Target) SetHealthy(healthy bool) {
+	t.healthy.Store(healthy)
+}
+
+func (t *Target) String() string {
+	return t.URL.String()
+}
+
+// InFlight returns the number of requests currently sent to the target
+func (t *Target) InFlight() int64 {
+	return t.inFlight.Load()
+}
+
+// Pool is a named group of targets behind a load-balancing strategy
+type Pool struct {
+	Name     string
+	Targets  []*Target
+	balancer LoadBalancer
+	hashKey  func(r *http.Request, clientIP string) string
+	// Breaker is nil when the upstream has no circuit breaker
+	Breaker *Breaker
+
+	stopHealth chan struct{}
+}
+
+// NewPool creates a pool. strategy is one of the Strategy* names (empty means
+// round robin); hashKey is "client_ip" or "header:<Name>" and is only used by
+// the consistent hash strategy.
+func NewPool(name string, targets []*Target, strategy, hashKey string) (*Pool, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("upstream %q has no targets", name)
+	}
+	for _, t := range targets {
+		if t.Weight < 0 {
+			t.Weight = 0
+		}
+	}
+	balancer, err := NewLoadBalancer(strategy, targets)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %v", name, err)
+	}
+	pool := &Pool{
+		Name:     name,
+		Targets:  targets,
+		balancer: balancer,
+	}
+	switch {
+	case hashKey == "" || hashKey == "client_ip":
+		pool.hashKey = func(r *http.Request, clientIP string) string { return clientIP }
+	case strings.HasPrefix(hashKey, "header:"):
+		header := http.CanonicalHeaderKey(strings.TrimPrefix(hashKey, "header:"))
+		pool.hashKey = func(r *http.Request, clientIP string) string {
+			if v := r.Header.Get(header); v != "" {
+				return v
+			}
+			return clientIP
+		}
+	default:
+		return nil, fmt.Errorf("upstream %q: hash_key must be client_ip or header:<Name>, got %q", name, hashKey)
+	}
+	return pool, nil
+}
+
+// Pick chooses a healthy target for a request. If every target is unhealthy
+// it fails open and balances across all of them rather than rejecting traffic
+// outright, since a broken health endpoint shouldn't take the service down.
+// Drained targets are never picked.
+func (p *Pool) Pick(r *http.Request, clientIP string) *Target {
+	candidates := weighted(p.Healthy())
+	if len(candidates) == 0 {
+		candidates = weighted(p.Targets)
+	}
+	return p.balancer.Next(candidates, p.hashKey(r, clientIP))
+}
+
+// PickExcluding is like Pick but skips targets in exclude, e.g. ones already
+// tried for this request. It returns nil if nothing else is available.
+func (p *Pool) PickExcluding(r *http.Request, clientIP string, exclude map[*Target]bool) *Target {
+	candidates := make([]*Target, 0, len(p.Targets))
+	for _, t := range p.Healthy() {
+		if !exclude[t] && t.Weight > 0 {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return p.balancer.Next(candidates, p.hashKey(r, clientIP))
+}
+
+// weighted returns the targets that aren't drained
+func weighted(targets []*Target) []*Target {
+	for i, t := range targets {
+		if t.Weight > 0 {
+			continue
+		}
+		kept := append(make([]*Target, 0, len(targets)), targets[:i]...)
+		for _, t := range targets[i+1:] {
+			if t.Weight > 0 {
+				kept = append(kept, t)
+			}
+		}
+		return kept
+	}
+	return targets
+}
+
+// Healthy returns the targets currently in rotation
+func (p *Pool) Healthy() []*Target {
+	healthy := make([]*Target, 0, len(p.Targets))
+	for _, t := range p.Targets {
+		if t.Healthy() {
+			healthy = append(healthy, t)
+		}
+	}
+	return healthy
+}
+
+// Target returns the pool's target with the given URL, or nil
+func (p *Pool) Target(rawURL string) *Target {
+	for _, t := range p.Targets {
+		if t.String() == rawURL {
+			return t
+		}
+	}
+	return nil
+}
+
+// Acquire and Release bracket a request sent to t, keeping its in-flight
+// count accurate for least-connections style balancing
+func (p *Pool) Acquire(t *Target) {
+	t.inFlight.Add(1)
+}
+
+func (p *Pool) Release(t *Target) {
+	t.inFlight.Add(-1)
+}
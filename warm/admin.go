@@ -0,0 +1,45 @@
+package warm
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// HandleWarm reports progress on GET and starts a warm-up on POST, from the
+// configured sources or from {"urls": [...]} in the body
+func (w *Warmer) HandleWarm(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			URLs []string `json:"urls"`
+		}
+		dec := json.NewDecoder(http.MaxBytesReader(rw, r.Body, 10<<20))
+		dec.DisallowUnknownFields()
+		// An empty body warms the configured sources
+		if err := dec.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(rw, "Invalid warm-up request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := w.Run(req.URLs); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrRunning) {
+				status = http.StatusConflict
+			}
+			http.Error(rw, err.Error(), status)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(rw).Encode(w.Progress())
+		return
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(w.Progress())
+}
@@ -0,0 +1,153 @@
+package warm
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"goproxy/config"
+)
+
+// maxSitemapBytes is the size limit the sitemap protocol sets per file
+const maxSitemapBytes = 50 << 20
+
+// sources collects the URLs to warm from the configured list, file and
+// sitemap
+func (w *Warmer) sources(cfg config.WarmConfig) ([]string, error) {
+	urls := append([]string{}, cfg.URLs...)
+	if cfg.URLList != "" {
+		list, err := readURLList(cfg.URLList)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, list...)
+	}
+	if cfg.Sitemap != "" {
+		locs, err := w.readSitemap(cfg, cfg.Sitemap, true)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, locs...)
+	}
+	return urls, nil
+}
+
+// readURLList reads one URL per line, skipping blank lines and # comments
+func readURLList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading warm-up URL list: %w", err)
+	}
+	defer f.Close()
+	var urls []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading warm-up URL list: %w", err)
+	}
+	return urls, nil
+}
+
+// sitemap matches both a <urlset> and a <sitemapindex>
+type sitemap struct {
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// readSitemap returns the page URLs in a sitemap, following a sitemap index
+// one level down. Sitemaps given as http(s) URLs are fetched through the
+// proxy; anything else is a file.
+func (w *Warmer) readSitemap(cfg config.WarmConfig, source string, followIndex bool) ([]string, error) {
+	data, err := w.loadSitemap(cfg, source)
+	if err != nil {
+		return nil, fmt.Errorf("sitemap %s: %w", source, err)
+	}
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("sitemap %s: %w", source, err)
+		}
+		if data, err = io.ReadAll(io.LimitReader(zr, maxSitemapBytes)); err != nil {
+			return nil, fmt.Errorf("sitemap %s: %w", source, err)
+		}
+	}
+	var sm sitemap
+	if err := xml.Unmarshal(data, &sm); err != nil {
+		return nil, fmt.Errorf("sitemap %s: %w", source, err)
+	}
+
+	urls := make([]string, 0, len(sm.URLs))
+	for _, u := range sm.URLs {
+		urls = append(urls, strings.TrimSpace(u.Loc))
+	}
+	if followIndex {
+		for _, s := range sm.Sitemaps {
+			locs, err := w.readSitemap(cfg, strings.TrimSpace(s.Loc), false)
+			if err != nil {
+				return nil, err
+			}
+			urls = append(urls, locs...)
+		}
+	}
+	return urls, nil
+}
+
+func (w *Warmer) loadSitemap(cfg config.WarmConfig, source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+	req, err := newRequest(w.ctx, cfg, source)
+	if err != nil {
+		return nil, err
+	}
+	rec := newRecorder(maxSitemapBytes)
+	if err := w.proxy.Prefetch(rec, req); err != nil {
+		return nil, err
+	}
+	if rec.status != http.StatusOK {
+		return nil, fmt.Errorf("status %d", rec.status)
+	}
+	return rec.body.Bytes(), nil
+}
+
+// recorder is the client end of a warm-up request. It keeps up to limit
+// bytes of the body.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	limit  int
+}
+
+func newRecorder(limit int) *recorder {
+	return &recorder{header: make(http.Header), status: http.StatusOK, limit: limit}
+}
+
+func (r *recorder) Header() http.Header { return r.header }
+
+func (r *recorder) WriteHeader(statusCode int) { r.status = statusCode }
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if room := r.limit - r.body.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		r.body.Write(p[:room])
+	}
+	return len(p), nil
+}
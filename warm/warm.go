@@ -0,0 +1,293 @@
+// Package warm pre-populates the cache after a restart, from a URL list or a
+// sitemap, and keeps configured hot URLs from expiring.
+package warm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"goproxy/config"
+	"goproxy/metrics"
+)
+
+// progressLogInterval is how often a running warm-up logs its progress
+const progressLogInterval = 5 * time.Second
+
+// maxLoggedFailures caps the failures logged individually per run
+const maxLoggedFailures = 10
+
+// ErrRunning is returned when a warm-up is started while one is in progress
+var ErrRunning = errors.New("cache warm-up already running")
+
+// Prefetcher runs internal requests through the proxy's routing and cache,
+// see proxy.ReverseProxy
+type Prefetcher interface {
+	Prefetch(w http.ResponseWriter, r *http.Request) error
+	CacheExpiry(r *http.Request) time.Time
+}
+
+// Progress describes the latest warm-up run
+type Progress struct {
+	Running    bool      `json:"running"`
+	Total      int       `json:"total"`
+	Done       int       `json:"done"`
+	Failed     int       `json:"failed"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// Warmer fetches URLs through the proxy so their responses are cached
+type Warmer struct {
+	proxy   Prefetcher
+	metrics *metrics.Collector
+
+	mu       sync.Mutex
+	cfg      config.WarmConfig
+	progress Progress
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func New(cfg config.WarmConfig, proxy Prefetcher, metricsCollector *metrics.Collector) *Warmer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Warmer{
+		proxy:   proxy,
+		metrics: metricsCollector,
+		cfg:     cfg,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Start begins the startup warm-up, if configured, and the hot URL refresh
+// in the background
+func (w *Warmer) Start() {
+	if w.config().OnStart {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			if err := w.Run(nil); err != nil {
+				log.Printf("Cache warm-up failed to start: %v", err)
+			}
+		}()
+	}
+	w.wg.Add(1)
+	go w.refreshHot()
+}
+
+// SetConfig applies a reloaded configuration to later runs and hot checks
+func (w *Warmer) SetConfig(cfg config.WarmConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cfg = cfg
+}
+
+func (w *Warmer) config() config.WarmConfig {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cfg
+}
+
+// Progress returns a snapshot of the latest run
+func (w *Warmer) Progress() Progress {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.progress
+}
+
+// Run starts warming urls in the background, or the configured urls,
+// url_list and sitemap if urls is empty
+func (w *Warmer) Run(urls []string) error {
+	cfg := w.config()
+	if len(urls) == 0 {
+		var err error
+		if urls, err = w.sources(cfg); err != nil {
+			return err
+		}
+	}
+	urls = dedupe(urls)
+
+	w.mu.Lock()
+	if w.progress.Running {
+		w.mu.Unlock()
+		return ErrRunning
+	}
+	w.progress = Progress{Running: true, Total: len(urls), StartedAt: time.Now()}
+	w.mu.Unlock()
+
+	log.Printf("Cache warm-up: fetching %d URLs with concurrency %d", len(urls), cfg.Concurrency)
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.run(cfg, urls)
+	}()
+	return nil
+}
+
+func (w *Warmer) run(cfg config.WarmConfig, urls []string) {
+	jobs := make(chan string)
+	var workers sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for raw := range jobs {
+				w.record(raw, w.fetch(cfg, raw, false))
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(progressLogInterval)
+	defer ticker.Stop()
+feed:
+	for _, raw := range urls {
+		for {
+			select {
+			case jobs <- raw:
+				continue feed
+			case <-ticker.C:
+				p := w.Progress()
+				log.Printf("Cache warm-up: %d/%d done, %d failed", p.Done, p.Total, p.Failed)
+			case <-w.ctx.Done():
+				break feed
+			}
+		}
+	}
+	close(jobs)
+	workers.Wait()
+
+	w.mu.Lock()
+	w.progress.Running = false
+	w.progress.FinishedAt = time.Now()
+	p := w.progress
+	w.mu.Unlock()
+	log.Printf("Cache warm-up finished in %v: %d/%d done, %d failed",
+		p.FinishedAt.Sub(p.StartedAt).Round(time.Millisecond), p.Done, p.Total, p.Failed)
+}
+
+// record counts the result of warming one URL
+func (w *Warmer) record(raw string, err error) {
+	w.metrics.IncrementCacheWarmed(err == nil)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.progress.Done++
+	if err == nil {
+		return
+	}
+	w.progress.Failed++
+	w.progress.LastError = err.Error()
+	if w.progress.Failed <= maxLoggedFailures {
+		log.Printf("Cache warm-up: %s: %v", raw, err)
+	}
+}
+
+// fetch requests raw through the proxy; force refetches a fresh entry
+func (w *Warmer) fetch(cfg config.WarmConfig, raw string, force bool) error {
+	req, err := newRequest(w.ctx, cfg, raw)
+	if err != nil {
+		return err
+	}
+	if force {
+		req.Header.Set("Cache-Control", "no-cache")
+	}
+	rec := newRecorder(0)
+	if err := w.proxy.Prefetch(rec, req); err != nil {
+		return err
+	}
+	if rec.status >= http.StatusBadRequest {
+		return fmt.Errorf("status %d", rec.status)
+	}
+	return nil
+}
+
+// refreshHot refetches hot URLs whose entries are missing or about to expire
+func (w *Warmer) refreshHot() {
+	defer w.wg.Done()
+	for {
+		cfg := w.config()
+		interval := cfg.CheckInterval.Duration
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		select {
+		case <-time.After(interval):
+		case <-w.ctx.Done():
+			return
+		}
+
+		for _, raw := range cfg.Hot {
+			req, err := newRequest(w.ctx, cfg, raw)
+			if err != nil {
+				log.Printf("Cache warm-up: hot URL %s: %v", raw, err)
+				continue
+			}
+			expires := w.proxy.CacheExpiry(req)
+			if !expires.IsZero() && time.Until(expires) > cfg.RefreshBefore.Duration {
+				continue
+			}
+			err = w.fetch(cfg, raw, true)
+			w.metrics.IncrementCacheWarmed(err == nil)
+			if err != nil {
+				log.Printf("Cache warm-up: refreshing hot URL %s: %v", raw, err)
+			}
+		}
+	}
+}
+
+// newRequest builds the GET that warms raw. Absolute URLs keep their host as
+// the Host header; the configured prefix is prepended to the path.
+func newRequest(ctx context.Context, cfg config.WarmConfig, raw string) (*http.Request, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, err
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	target := cfg.Prefix + path
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host != "" {
+		req.Host = u.Host
+	}
+	for name, value := range cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+func dedupe(urls []string) []string {
+	seen := make(map[string]bool, len(urls))
+	out := make([]string, 0, len(urls))
+	for _, u := range urls {
+		u = strings.TrimSpace(u)
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		out = append(out, u)
+	}
+	return out
+}
+
+// Close stops a running warm-up and the hot URL refresh
+func (w *Warmer) Close() {
+	w.cancel()
+	w.wg.Wait()
+}